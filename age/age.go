@@ -0,0 +1,37 @@
+// Package age counts ages in full years from Unix birth dates. Birthdays start
+// at midnight in a configurable time zone, UTC by default, and people born on
+// February 29 turn a year older on March 1 in common years.
+package age
+
+import "time"
+
+var location = time.UTC
+
+// SetLocation sets the time zone birthdays are counted in. It is meant to be
+// called once at startup, before any age is computed.
+func SetLocation(loc *time.Location) {
+	location = loc
+}
+
+// Turning returns the range [from, to) of the birth dates of whoever turns years
+// old on the day of now. Those born before from are older, those born at or after
+// to are younger.
+func Turning(years int, now time.Time) (int64, int64) {
+	now = now.In(location)
+	return lastBirthDate(years, now.AddDate(0, 0, -1)), lastBirthDate(years, now)
+}
+
+// lastBirthDate returns the end of the last day someone could be born on and be
+// years old on the day of now: the same day years ago, or the end of the month
+// when that day does not exist, e.g. February 29 in a common year.
+func lastBirthDate(years int, now time.Time) int64 {
+	year, month, day := now.Year()-years, now.Month(), now.Day()
+	if last := daysIn(year, month); day > last {
+		day = last
+	}
+	return time.Date(year, month, day+1, 0, 0, 0, 0, location).Unix()
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
@@ -0,0 +1,65 @@
+package age
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string, loc *time.Location) int64 {
+	t, err := time.ParseInLocation("2006-01-02T15:04", s, loc)
+	if err != nil {
+		panic(err)
+	}
+	return t.Unix()
+}
+
+func TestTurning(t *testing.T) {
+	tokyo := time.FixedZone("UTC+9", 9*60*60)
+
+	tests := []struct {
+		name     string
+		loc      *time.Location
+		years    int
+		now      string
+		from, to string
+	}{
+		{"any day", time.UTC, 30, "2017-06-15T12:00", "1987-06-15T00:00", "1987-06-16T00:00"},
+		{"midnight", time.UTC, 30, "2017-06-15T00:00", "1987-06-15T00:00", "1987-06-16T00:00"},
+		{"end of day", time.UTC, 30, "2017-06-15T23:59", "1987-06-15T00:00", "1987-06-16T00:00"},
+		{"newborn", time.UTC, 0, "2017-06-15T12:00", "2017-06-15T00:00", "2017-06-16T00:00"},
+		{"leap day on leap day", time.UTC, 4, "2016-02-29T12:00", "2012-02-29T00:00", "2012-03-01T00:00"},
+		{"nobody on leap day", time.UTC, 1, "2016-02-29T12:00", "2015-03-01T00:00", "2015-03-01T00:00"},
+		{"leap day on March 1", time.UTC, 21, "2017-03-01T12:00", "1996-02-29T00:00", "1996-03-02T00:00"},
+		{"February 28 in a common year", time.UTC, 1, "2017-02-28T12:00", "2016-02-28T00:00", "2016-02-29T00:00"},
+		{"new year", time.UTC, 10, "2017-01-01T00:00", "2007-01-01T00:00", "2007-01-02T00:00"},
+		{"local day", tokyo, 30, "2017-06-15T05:00", "1987-06-15T00:00", "1987-06-16T00:00"},
+	}
+
+	defer SetLocation(time.UTC)
+
+	for _, tt := range tests {
+		SetLocation(tt.loc)
+		now := time.Unix(date(tt.now, tt.loc), 0).UTC()
+
+		from, to := Turning(tt.years, now)
+		if from != date(tt.from, tt.loc) || to != date(tt.to, tt.loc) {
+			t.Errorf("%s: got [%s, %s), want [%s, %s)", tt.name,
+				time.Unix(from, 0).In(tt.loc), time.Unix(to, 0).In(tt.loc), tt.from, tt.to)
+		}
+	}
+}
+
+// TestTurningElsewhere checks that the day of now is the one of the configured
+// time zone rather than the UTC one.
+func TestTurningElsewhere(t *testing.T) {
+	defer SetLocation(time.UTC)
+	SetLocation(time.FixedZone("UTC-5", -5*60*60))
+
+	// 2017-06-15 01:00 UTC is still June 14 at UTC-5.
+	from, to := Turning(18, time.Date(2017, 6, 15, 1, 0, 0, 0, time.UTC))
+
+	born := time.Date(1999, 6, 14, 0, 0, 0, 0, location).Unix()
+	if from != born || to != born+24*60*60 {
+		t.Errorf("got [%s, %s), want the day of %s", time.Unix(from, 0).In(location), time.Unix(to, 0).In(location), time.Unix(born, 0).In(location))
+	}
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+)
+
+type Role int
+
+// Roles are ordered: a role is granted everything the roles below it are. A
+// reader is authenticated but refused writes.
+const (
+	Reader Role = iota + 1
+	Writer
+	Admin
+)
+
+var roleNames = map[Role]string{
+	Reader: "reader",
+	Writer: "writer",
+	Admin:  "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, n := range roleNames {
+		if n == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+type apiKey struct {
+	key       []byte
+	principal Principal
+}
+
+// Authenticator accepts static API keys sent as X-Api-Key and HMAC-SHA256 signed
+// bearer tokens issued with Sign.
+type Authenticator struct {
+	keys      []apiKey
+	secret    []byte
+	anonymous bool
+}
+
+var (
+	errNoCredentials = errors.New("credentials required")
+	errBadKey        = errors.New("invalid API key")
+	errBadToken      = errors.New("invalid bearer token")
+	errExpired       = errors.New("bearer token expired")
+)
+
+const principalKey = "principal"
+
+func New(secret []byte) *Authenticator {
+	return &Authenticator{secret: secret}
+}
+
+// FromEnv configures API keys from TRAVELS_API_KEYS, a comma separated list of
+// name:key:role entries, and the token secret from TRAVELS_TOKEN_SECRET.
+func FromEnv() (*Authenticator, error) {
+	a := New([]byte(os.Getenv("TRAVELS_TOKEN_SECRET")))
+
+	keys := os.Getenv("TRAVELS_API_KEYS")
+	if keys == "" {
+		return a, nil
+	}
+
+	for _, entry := range strings.Split(keys, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("API key entry %q: expected name:key:role", parts[0])
+		}
+
+		role, err := ParseRole(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("API key %q: %v", parts[0], err)
+		}
+
+		a.AddKey(parts[0], parts[1], role)
+	}
+
+	return a, nil
+}
+
+func (a *Authenticator) AddKey(name, key string, role Role) {
+	a.keys = append(a.keys, apiKey{key: []byte(key), principal: Principal{Name: name, Role: role}})
+}
+
+// Enabled reports whether any credential is configured. Without any, Require
+// answers 401 to every request unless AllowAnonymous was called.
+func (a *Authenticator) Enabled() bool {
+	return len(a.keys) > 0 || len(a.secret) > 0
+}
+
+// AllowAnonymous opts out of authentication while no credential is configured:
+// Require then lets writes through and still refuses admin routes. It has no
+// effect once keys or a token secret are set.
+func (a *Authenticator) AllowAnonymous() {
+	a.anonymous = true
+}
+
+type claims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Sign issues a bearer token for subject valid for ttl, see the -issue-token flag.
+func (a *Authenticator) Sign(subject string, role Role, ttl time.Duration) (string, error) {
+	if len(a.secret) == 0 {
+		return "", errors.New("no token secret configured")
+	}
+
+	payload, err := json.Marshal(claims{Subject: subject, Role: role.String(), ExpiresAt: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + a.signature(encoded), nil
+}
+
+func (a *Authenticator) signature(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *Authenticator) Authenticate(ctx *fasthttp.RequestCtx) (Principal, error) {
+	if key := ctx.Request.Header.Peek("X-Api-Key"); len(key) > 0 {
+		for _, k := range a.keys {
+			if hmac.Equal(k.key, key) {
+				return k.principal, nil
+			}
+		}
+		return Principal{}, errBadKey
+	}
+
+	header := string(ctx.Request.Header.Peek("Authorization"))
+	if !strings.HasPrefix(header, "Bearer ") {
+		return Principal{}, errNoCredentials
+	}
+
+	return a.verify(strings.TrimSpace(header[len("Bearer "):]), time.Now())
+}
+
+func (a *Authenticator) verify(token string, now time.Time) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(a.secret) == 0 || len(parts) != 2 {
+		return Principal{}, errBadToken
+	}
+
+	if !hmac.Equal([]byte(a.signature(parts[0])), []byte(parts[1])) {
+		return Principal{}, errBadToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Principal{}, errBadToken
+	}
+
+	var c claims
+	if err = json.Unmarshal(payload, &c); err != nil {
+		return Principal{}, errBadToken
+	}
+
+	role, err := ParseRole(c.Role)
+	if err != nil || c.Subject == "" {
+		return Principal{}, errBadToken
+	}
+
+	if now.Unix() >= c.ExpiresAt {
+		return Principal{}, errExpired
+	}
+
+	return Principal{Name: c.Subject, Role: role}, nil
+}
+
+// Require answers 401 to unauthenticated requests and 403 to callers whose role
+// is below role, so without credentials configured every request is refused.
+// After AllowAnonymous it then answers 403 when role is Admin and lets other
+// requests through.
+func (a *Authenticator) Require(role Role) routing.Handler {
+	return func(ctx *routing.Context) error {
+		if !a.Enabled() && a.anonymous {
+			if role >= Admin {
+				utils.ResponseWithError(ctx, fmt.Errorf("role %s is required and no credentials are configured", role), http.StatusForbidden)
+				ctx.Abort()
+			}
+			return nil
+		}
+
+		principal, err := a.Authenticate(ctx.RequestCtx)
+		if err != nil {
+			ctx.Response.Header.Set("WWW-Authenticate", `Bearer realm="travels"`)
+			utils.ResponseWithError(ctx, err, http.StatusUnauthorized)
+			ctx.Abort()
+			return nil
+		}
+
+		if principal.Role < role {
+			utils.ResponseWithError(ctx, fmt.Errorf("role %s is required", role), http.StatusForbidden)
+			ctx.Abort()
+			return nil
+		}
+
+		ctx.SetUserValue(principalKey, principal)
+		return nil
+	}
+}
+
+// Client tells callers apart for rate limiting: by the authenticated principal
+// when the credentials are valid and by the client IP otherwise, so that made-up
+// credentials share the bucket of their IP.
+func (a *Authenticator) Client(ctx *fasthttp.RequestCtx) string {
+	if principal, err := a.Authenticate(ctx); err == nil {
+		return "principal:" + principal.Name
+	}
+	return "ip:" + ctx.RemoteIP().String()
+}
+
+// Identity names the caller of a request, the client IP when it was not
+// authenticated.
+func Identity(ctx *fasthttp.RequestCtx) string {
+	if principal, ok := ctx.UserValue(principalKey).(Principal); ok {
+		return principal.Name
+	}
+	return ctx.RemoteIP().String()
+}
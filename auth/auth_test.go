@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+)
+
+func request(header, value string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, nil)
+	if header != "" {
+		ctx.Request.Header.Set(header, value)
+	}
+	return ctx
+}
+
+func TestParseRole(t *testing.T) {
+	for name, want := range map[string]Role{"reader": Reader, "writer": Writer, "admin": Admin} {
+		role, err := ParseRole(name)
+		if err != nil || role != want || role.String() != name {
+			t.Errorf("%s: got %v, %v", name, role, err)
+		}
+	}
+
+	for _, name := range []string{"", "guest", "Admin"} {
+		if _, err := ParseRole(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TRAVELS_TOKEN_SECRET", "")
+	t.Setenv("TRAVELS_API_KEYS", "ci:k1:writer, ops:k2:admin, bi:k3:reader")
+
+	a, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal, err := a.Authenticate(request("X-Api-Key", "k2"))
+	if err != nil || principal != (Principal{Name: "ops", Role: Admin}) {
+		t.Errorf("got %+v, %v", principal, err)
+	}
+
+	principal, err = a.Authenticate(request("X-Api-Key", "k3"))
+	if err != nil || principal != (Principal{Name: "bi", Role: Reader}) {
+		t.Errorf("got %+v, %v", principal, err)
+	}
+
+	for _, keys := range []string{"ci:k1", ":k1:writer", "ci::writer", "ci:k1:guest"} {
+		t.Setenv("TRAVELS_API_KEYS", keys)
+		if _, err := FromEnv(); err == nil {
+			t.Errorf("%q: expected an error", keys)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	a := New([]byte("secret"))
+	token, err := a.Sign("deploy", Admin, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal, err := a.verify(token, time.Now())
+	if err != nil || principal != (Principal{Name: "deploy", Role: Admin}) {
+		t.Errorf("got %+v, %v", principal, err)
+	}
+
+	if _, err := a.verify(token, time.Now().Add(time.Hour)); err != errExpired {
+		t.Errorf("expired token: got %v", err)
+	}
+
+	if _, err := New([]byte("other")).verify(token, time.Now()); err != errBadToken {
+		t.Errorf("token of another secret: got %v", err)
+	}
+
+	payload := token[:strings.Index(token, ".")]
+	for _, forged := range []string{payload, payload + ".", "x" + token, token + "x"} {
+		if _, err := a.verify(forged, time.Now()); err != errBadToken {
+			t.Errorf("%q: got %v", forged, err)
+		}
+	}
+
+	if _, err := New(nil).Sign("deploy", Admin, time.Hour); err == nil {
+		t.Error("signed without a secret")
+	}
+	if _, err := New(nil).verify(token, time.Now()); err != errBadToken {
+		t.Errorf("verified without a secret: got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := New([]byte("secret"))
+	a.AddKey("ci", "k1", Writer)
+	token, _ := a.Sign("deploy", Admin, time.Hour)
+
+	tests := []struct {
+		header, value string
+		want          Principal
+		err           error
+	}{
+		{"X-Api-Key", "k1", Principal{Name: "ci", Role: Writer}, nil},
+		{"X-Api-Key", "k2", Principal{}, errBadKey},
+		{"Authorization", "Bearer " + token, Principal{Name: "deploy", Role: Admin}, nil},
+		{"Authorization", "Bearer nope", Principal{}, errBadToken},
+		{"Authorization", "Basic " + token, Principal{}, errNoCredentials},
+		{"", "", Principal{}, errNoCredentials},
+	}
+
+	for _, tt := range tests {
+		principal, err := a.Authenticate(request(tt.header, tt.value))
+		if principal != tt.want || err != tt.err {
+			t.Errorf("%s %q: got %+v, %v", tt.header, tt.value, principal, err)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	enabled := New(nil)
+	enabled.AddKey("ci", "k1", Writer)
+	enabled.AddKey("ops", "k2", Admin)
+	enabled.AddKey("bi", "k4", Reader)
+	disabled := New(nil)
+	anonymous := New(nil)
+	anonymous.AllowAnonymous()
+	ignored := New(nil)
+	ignored.AddKey("ci", "k1", Writer)
+	ignored.AllowAnonymous()
+
+	tests := []struct {
+		a    *Authenticator
+		role Role
+		key  string
+		want int
+	}{
+		{disabled, Writer, "", http.StatusUnauthorized},
+		{disabled, Writer, "k1", http.StatusUnauthorized},
+		{disabled, Admin, "", http.StatusUnauthorized},
+		{anonymous, Writer, "", http.StatusOK},
+		{anonymous, Admin, "", http.StatusForbidden},
+		{anonymous, Admin, "k2", http.StatusForbidden},
+		{ignored, Writer, "", http.StatusUnauthorized},
+		{ignored, Writer, "k1", http.StatusOK},
+		{enabled, Writer, "", http.StatusUnauthorized},
+		{enabled, Writer, "k3", http.StatusUnauthorized},
+		{enabled, Writer, "k1", http.StatusOK},
+		{enabled, Writer, "k4", http.StatusForbidden},
+		{enabled, Reader, "k4", http.StatusOK},
+		{enabled, Admin, "k1", http.StatusForbidden},
+		{enabled, Admin, "k2", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		ctx := &routing.Context{RequestCtx: request("X-Api-Key", tt.key)}
+		if tt.key == "" {
+			ctx.RequestCtx = request("", "")
+		}
+
+		tt.a.Require(tt.role)(ctx)
+		if code := ctx.Response.StatusCode(); code != tt.want {
+			t.Errorf("enabled %v, anonymous %v, role %s, key %q: got %d, want %d", tt.a.Enabled(), tt.a.anonymous, tt.role, tt.key, code, tt.want)
+		}
+		if tt.want == http.StatusOK && tt.key != "" && Identity(ctx.RequestCtx) == "10.0.0.1" {
+			t.Errorf("key %q: the principal was not recorded", tt.key)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	a := New(nil)
+	a.AddKey("ci", "k1", Writer)
+
+	if got := a.Client(request("X-Api-Key", "k1")); got != "principal:ci" {
+		t.Errorf("valid key: got %q", got)
+	}
+	if got := a.Client(request("X-Api-Key", "made-up")); got != "ip:10.0.0.1" {
+		t.Errorf("invalid key: got %q", got)
+	}
+	if got := a.Client(request("", "")); got != "ip:10.0.0.1" {
+		t.Errorf("no key: got %q", got)
+	}
+}
@@ -0,0 +1,403 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/agneum/travels/logging"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	outboxCollection    = "outbox"
+	revisionsCollection = "revisions"
+	dispatchInterval    = time.Second
+	stageTimeout        = time.Minute
+	batchSize           = 100
+	maxAttempts         = 10
+)
+
+// Event describes a write on an entity, e.g. visit.created or location.updated.
+// Data holds the whole document as stored after the write.
+type Event struct {
+	Id       string `json:"id" bson:"id"`
+	Type     string `json:"type" bson:"type"`
+	Entity   string `json:"entity" bson:"entity"`
+	EntityId uint32 `json:"entity_id" bson:"entity_id"`
+	Data     bson.M `json:"data" bson:"data"`
+	At       int64  `json:"at" bson:"at"`
+}
+
+// Sink receives events. Deliver is retried with a backoff until it succeeds, so it
+// must be safe to receive the same event twice.
+type Sink interface {
+	Name() string
+	Deliver(e Event) error
+}
+
+// outboxEntry is the delivery of one event to one sink, so that every sink moves
+// through the outbox at its own pace.
+type outboxEntry struct {
+	Id          bson.ObjectId `bson:"_id"`
+	Sink        string        `bson:"sink"`
+	Event       Event         `bson:"event"`
+	Staged      bool          `bson:"staged"`
+	Attempts    int           `bson:"attempts"`
+	NextAttempt time.Time     `bson:"next_attempt"`
+	Failed      bool          `bson:"failed"`
+	LastError   string        `bson:"last_error,omitempty"`
+}
+
+// Publisher stores every event in an outbox collection before the write it
+// describes and delivers it to the sinks in the background, each sink on its
+// own, so events survive a crash, a restart or a sink being down.
+type Publisher struct {
+	session *mgo.Session
+	sinks   []Sink
+	wake    []chan struct{}
+	local   []Sink
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func NewPublisher(s *mgo.Session, sinks ...Sink) *Publisher {
+	p := &Publisher{
+		session: s,
+		sinks:   sinks,
+		wake:    make([]chan struct{}, len(sinks)),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	var workers sync.WaitGroup
+	for i, sink := range sinks {
+		p.wake[i] = make(chan struct{}, 1)
+		workers.Add(1)
+		go func(sink Sink, wake chan struct{}) {
+			defer workers.Done()
+			p.run(sink, wake)
+		}(sink, p.wake[i])
+	}
+
+	go func() {
+		workers.Wait()
+		close(p.done)
+	}()
+
+	return p
+}
+
+// AddLocal registers a sink living in this process, such as a Hub. Local sinks
+// get events synchronously once the write is made and bypass the outbox. It must
+// be called before the publisher is shared.
+func (p *Publisher) AddLocal(sink Sink) {
+	p.local = append(p.local, sink)
+}
+
+// TokenField is where a write stores the Token of its intent, on the entity and
+// then on the revision keeping that version once it is replaced.
+const TokenField = "write_token"
+
+// Intent is an event staged in the outbox before the write it describes. Commit
+// releases it once the write is made and Abort drops it when the write failed.
+// An intent left staged, e.g. by a crash in between, is delivered after
+// stageTimeout if the write landed, which the entity or its revisions tell by
+// the token of the intent in TokenField, and dropped otherwise.
+type Intent struct {
+	p     *Publisher
+	event Event
+	ended bool
+}
+
+// Token identifies the write of the intent, empty without a publisher.
+func (i *Intent) Token() string {
+	if i == nil {
+		return ""
+	}
+	return i.event.Id
+}
+
+// Stage records the event of a write about to be made at the Unix time at, with
+// data holding the document as it will be stored.
+func (p *Publisher) Stage(eventType, entity string, id uint32, at int64, data bson.M) (*Intent, error) {
+	intents, err := p.StageAll([]Event{{
+		Type:     eventType,
+		Entity:   entity,
+		EntityId: id,
+		Data:     data,
+		At:       at,
+	}})
+	if err != nil || intents == nil {
+		return nil, err
+	}
+	return intents[0], nil
+}
+
+// StageAll records the events of writes about to be made in bulk with a single
+// insert. The ids of the events are assigned here.
+func (p *Publisher) StageAll(events []Event) (Intents, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	intents := make(Intents, len(events))
+	entries := make([]interface{}, 0, len(events)*len(p.sinks))
+	for i, e := range events {
+		e.Id = bson.NewObjectId().Hex()
+		intents[i] = &Intent{p: p, event: e}
+
+		for _, sink := range p.sinks {
+			entries = append(entries, &outboxEntry{
+				Id:          bson.NewObjectId(),
+				Sink:        sink.Name(),
+				Event:       e,
+				Staged:      true,
+				NextAttempt: time.Now().Add(stageTimeout),
+			})
+		}
+	}
+
+	if len(entries) == 0 {
+		return intents, nil
+	}
+
+	session := p.session.Copy()
+	defer session.Close()
+
+	err := session.DB("travels").C(outboxCollection).Insert(entries...)
+	if err != nil {
+		return nil, err
+	}
+
+	return intents, nil
+}
+
+// Commit hands the event to the local sinks and makes it due for the others.
+func (i *Intent) Commit() error {
+	return Intents{i}.Commit()
+}
+
+// Abort drops an intent whose write was not made. It does nothing after Commit,
+// so it can be deferred right after Stage.
+func (i *Intent) Abort() {
+	Intents{i}.Abort()
+}
+
+// Intents are events staged together, committed or aborted with a single update.
+type Intents []*Intent
+
+// Commit hands the events to the local sinks and makes them due for the others.
+func (is Intents) Commit() error {
+	p, ended := is.end()
+	if p == nil {
+		return nil
+	}
+
+	for _, i := range ended {
+		for _, sink := range p.local {
+			sink.Deliver(i.event)
+		}
+	}
+
+	if len(p.sinks) == 0 {
+		return nil
+	}
+
+	session := p.session.Copy()
+	defer session.Close()
+
+	_, err := session.DB("travels").C(outboxCollection).UpdateAll(
+		bson.M{"event.id": bson.M{"$in": ended.ids()}, "staged": true},
+		bson.M{"$set": bson.M{"staged": false, "next_attempt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, wake := range p.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Abort drops the events whose writes were not made, leaving out those already
+// committed.
+func (is Intents) Abort() {
+	p, ended := is.end()
+	if p == nil || len(p.sinks) == 0 {
+		return
+	}
+	ids := ended.ids()
+
+	session := p.session.Copy()
+	defer session.Close()
+
+	_, err := session.DB("travels").C(outboxCollection).RemoveAll(bson.M{"event.id": bson.M{"$in": ids}, "staged": true})
+	if err != nil {
+		logging.Log(logging.Warn, "unable to drop aborted events", logging.Fields{"events": ids, "error": err})
+	}
+}
+
+// end marks the intents not yet committed or aborted as ended and returns them
+// with their publisher, nil when there is none left.
+func (is Intents) end() (*Publisher, Intents) {
+	var p *Publisher
+	var ended Intents
+	for _, i := range is {
+		if i == nil || i.ended {
+			continue
+		}
+		i.ended = true
+		p = i.p
+		ended = append(ended, i)
+	}
+	return p, ended
+}
+
+func (is Intents) ids() []string {
+	ids := make([]string, len(is))
+	for n, i := range is {
+		ids[n] = i.event.Id
+	}
+	return ids
+}
+
+// Close delivers what is due one last time and stops the background delivery,
+// giving up when ctx is done first.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Publisher) run(sink Sink, wake chan struct{}) {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			p.dispatch(sink)
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+		p.dispatch(sink)
+	}
+}
+
+func (p *Publisher) dispatch(sink Sink) {
+	session := p.session.Copy()
+	defer session.Close()
+
+	db := session.DB("travels")
+	c := db.C(outboxCollection)
+
+	var entries []outboxEntry
+	err := c.Find(bson.M{
+		"sink":         sink.Name(),
+		"failed":       false,
+		"next_attempt": bson.M{"$lte": time.Now()},
+	}).Sort("_id").Limit(batchSize).All(&entries)
+	if err != nil {
+		logging.Log(logging.Error, "unable to read the event outbox", logging.Fields{"sink": sink.Name(), "error": err})
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.Staged && !p.resolve(db, entry) {
+			continue
+		}
+		p.deliver(c, sink, entry)
+	}
+}
+
+// resolve settles an intent left staged: it reports whether its write landed and
+// drops it when it did not.
+func (p *Publisher) resolve(db *mgo.Database, entry outboxEntry) bool {
+	e := entry.Event
+
+	n, err := db.C(e.Entity).Find(bson.M{"id": e.EntityId, TokenField: e.Id}).Count()
+	if err == nil && n == 0 {
+		n, err = db.C(revisionsCollection).Find(bson.M{
+			"entity":    e.Entity,
+			"entity_id": e.EntityId,
+			TokenField:  e.Id,
+		}).Count()
+	}
+	if err != nil {
+		logging.Log(logging.Error, "unable to resolve staged event", logging.Fields{"event": e.Id, "error": err})
+		return false
+	}
+
+	if n > 0 {
+		return true
+	}
+
+	if err := db.C(outboxCollection).RemoveId(entry.Id); err != nil {
+		logging.Log(logging.Error, "unable to drop staged event", logging.Fields{"event": e.Id, "error": err})
+	}
+	logging.Log(logging.Warn, "dropped event of a write that was not made", logging.Fields{"event": e.Id, "type": e.Type})
+	return false
+}
+
+func (p *Publisher) deliver(c *mgo.Collection, sink Sink, entry outboxEntry) {
+	err := sink.Deliver(entry.Event)
+	if err == nil {
+		if err := c.RemoveId(entry.Id); err != nil {
+			logging.Log(logging.Error, "unable to clear delivered event", logging.Fields{"event": entry.Event.Id, "error": err})
+		}
+		return
+	}
+
+	attempts := entry.Attempts + 1
+	failed := attempts >= maxAttempts
+	update := bson.M{
+		"staged":       false,
+		"attempts":     attempts,
+		"next_attempt": time.Now().Add(backoff(attempts)),
+		"failed":       failed,
+		"last_error":   err.Error(),
+	}
+
+	if err := c.UpdateId(entry.Id, bson.M{"$set": update}); err != nil {
+		logging.Log(logging.Error, "unable to reschedule event", logging.Fields{"event": entry.Event.Id, "error": err})
+	}
+
+	level := logging.Warn
+	if failed {
+		level = logging.Error
+	}
+	logging.Log(level, "event delivery failed", logging.Fields{
+		"event":    entry.Event.Id,
+		"type":     entry.Event.Type,
+		"sink":     sink.Name(),
+		"attempts": attempts,
+		"gave_up":  failed,
+		"error":    err,
+	})
+}
+
+// backoff doubles the delay after every failed attempt, up to ten minutes.
+func backoff(attempts int) time.Duration {
+	delay := time.Second << uint(attempts)
+	if delay > 10*time.Minute || delay <= 0 {
+		return 10 * time.Minute
+	}
+	return delay
+}
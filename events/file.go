@@ -0,0 +1,50 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// File appends every event as one JSON line to a local file.
+type File struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func NewFile(path string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{path: path, file: file}, nil
+}
+
+func (f *File) Name() string {
+	return "file:" + f.path
+}
+
+func (f *File) Deliver(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err = f.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return f.file.Sync()
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
@@ -0,0 +1,82 @@
+package events
+
+import "sync"
+
+const subscriptionBuffer = 64
+
+// Hub fans events out to in-process subscribers such as open SSE streams. A
+// subscriber that does not keep up loses events instead of slowing writes down.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+type Subscription struct {
+	C     chan Event
+	match func(Event) bool
+	hub   *Hub
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[*Subscription]struct{})}
+}
+
+func (h *Hub) Name() string {
+	return "hub"
+}
+
+func (h *Hub) Deliver(e Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		if !sub.match(e) {
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Subscribe returns a subscription receiving the events match accepts. Its
+// channel is closed by Close on either the subscription or the hub.
+func (h *Hub) Subscribe(match func(Event) bool) *Subscription {
+	sub := &Subscription{C: make(chan Event, subscriptionBuffer), match: match, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(sub.C)
+		return sub
+	}
+	h.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	if _, ok := s.hub.subscribers[s]; ok {
+		delete(s.hub.subscribers, s)
+		close(s.C)
+	}
+}
+
+// Close ends every subscription, e.g. so that streams finish on shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.C)
+	}
+}
@@ -0,0 +1,117 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func visits(e Event) bool {
+	return e.Entity == "visits"
+}
+
+func receive(t *testing.T, sub *Subscription) (Event, bool) {
+	t.Helper()
+
+	select {
+	case e, ok := <-sub.C:
+		return e, ok
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return Event{}, false
+	}
+}
+
+func TestHubFanOut(t *testing.T) {
+	hub := NewHub()
+	first := hub.Subscribe(visits)
+	second := hub.Subscribe(visits)
+	all := hub.Subscribe(func(Event) bool { return true })
+
+	hub.Deliver(Event{Id: "1", Entity: "users"})
+	hub.Deliver(Event{Id: "2", Entity: "visits"})
+
+	for _, sub := range []*Subscription{first, second} {
+		if e, _ := receive(t, sub); e.Id != "2" {
+			t.Errorf("got event %q, want 2", e.Id)
+		}
+		if len(sub.C) != 0 {
+			t.Errorf("got %d events more, want none", len(sub.C))
+		}
+	}
+	for _, want := range []string{"1", "2"} {
+		if e, _ := receive(t, all); e.Id != want {
+			t.Errorf("got event %q, want %s", e.Id, want)
+		}
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	hub := NewHub()
+	closed := hub.Subscribe(visits)
+	open := hub.Subscribe(visits)
+
+	closed.Close()
+	closed.Close()
+	hub.Deliver(Event{Id: "1", Entity: "visits"})
+
+	if _, ok := receive(t, closed); ok {
+		t.Error("the closed subscription received an event")
+	}
+	if e, ok := receive(t, open); !ok || e.Id != "1" {
+		t.Errorf("got event %q, %v, want 1", e.Id, ok)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub()
+	subs := []*Subscription{hub.Subscribe(visits), hub.Subscribe(visits)}
+
+	hub.Close()
+	subs = append(subs, hub.Subscribe(visits))
+	hub.Deliver(Event{Id: "1", Entity: "visits"})
+
+	for i, sub := range subs {
+		if _, ok := receive(t, sub); ok {
+			t.Errorf("%d: the subscription is still open", i)
+		}
+		sub.Close()
+	}
+}
+
+func TestHubDropsForSlowSubscribers(t *testing.T) {
+	hub := NewHub()
+	slow := hub.Subscribe(visits)
+	fast := hub.Subscribe(visits)
+
+	deliver := func(n int) {
+		t.Helper()
+
+		delivered := make(chan struct{})
+		go func() {
+			defer close(delivered)
+
+			for i := 0; i < n; i++ {
+				hub.Deliver(Event{Id: "visit", Entity: "visits"})
+			}
+		}()
+
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatal("Deliver is blocked by a full subscription")
+		}
+	}
+
+	deliver(subscriptionBuffer + 1)
+	for len(fast.C) > 0 {
+		<-fast.C
+	}
+	deliver(1)
+
+	if len(fast.C) != 1 {
+		t.Errorf("the drained subscriber holds %d events, want 1", len(fast.C))
+	}
+	if len(slow.C) != subscriptionBuffer {
+		t.Errorf("the slow subscriber holds %d events, want %d", len(slow.C), subscriptionBuffer)
+	}
+}
@@ -0,0 +1,65 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook POSTs every event as JSON to a URL. When a secret is set the body is
+// signed and the signature sent as X-Travels-Signature: sha256=<hex>.
+type Webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhook(url string, secret []byte) *Webhook {
+	return &Webhook{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (w *Webhook) Name() string {
+	return "webhook:" + w.url
+}
+
+func (w *Webhook) Deliver(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Travels-Event", e.Type)
+	req.Header.Set("X-Travels-Delivery", e.Id)
+
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set("X-Travels-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered %d", w.url, resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,575 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type Type int
+
+const (
+	Int Type = iota
+	Float
+	String
+	Time
+)
+
+type Op string
+
+const (
+	Eq   Op = "eq"
+	Ne   Op = "ne"
+	Gt   Op = "gt"
+	Gte  Op = "gte"
+	Lt   Op = "lt"
+	Lte  Op = "lte"
+	In   Op = "in"
+	Like Op = "like"
+
+	// Within matches GeoJSON points inside a Circle. It is built by callers
+	// rather than parsed from the query string.
+	Within Op = "within"
+)
+
+var (
+	Range   = []Op{Eq, Gt, Gte, Lt, Lte}
+	Ordered = []Op{Eq, Ne, Gt, Gte, Lt, Lte, In}
+	Textual = []Op{Eq, Ne, In, Like}
+)
+
+var mongoOps = map[Op]string{
+	Eq:  "$eq",
+	Ne:  "$ne",
+	Gt:  "$gt",
+	Gte: "$gte",
+	Lt:  "$lt",
+	Lte: "$lte",
+	In:  "$in",
+}
+
+// Field declares a queryable field: the name used in the query string, the
+// document path it is compiled to and the operators allowed on it. Normalize, when
+// set, rewrites string values compared for equality to the form they are stored in;
+// Check, when set, rejects values out of the domain of the field.
+type Field struct {
+	Name      string
+	Path      string
+	Type      Type
+	Ops       []Op
+	Normalize func(string) string
+	Check     func(value interface{}) error
+}
+
+func (f Field) allows(op Op) bool {
+	for _, allowed := range f.Ops {
+		if allowed == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Param declares a plain query parameter, e.g. fromDate, compiled to a condition
+// on Field. Its value is read like Field[Op]=value, or Field[Inclusive]=value when
+// <Name>Inclusive=true is also given; an In parameter may be repeated. Build
+// replaces that for parameters needing more, such as the time of the request or
+// other arguments.
+type Param struct {
+	Name      string
+	Field     string
+	Op        Op
+	Inclusive Op
+	Build     func(field Field, value string, r Request) (Filter, error)
+}
+
+// Request is what a Param is built from besides its own value.
+type Request struct {
+	Args      *fasthttp.Args
+	Now       time.Time
+	Inclusive bool
+}
+
+type Schema struct {
+	fields map[string]Field
+	params []Param
+}
+
+func NewSchema(fields ...Field) *Schema {
+	s := &Schema{fields: make(map[string]Field, len(fields))}
+	for _, f := range fields {
+		if f.Path == "" {
+			f.Path = f.Name
+		}
+		s.fields[f.Name] = f
+	}
+	return s
+}
+
+// WithParams adds plain parameters to the schema. Their fields must be declared.
+func (s *Schema) WithParams(params ...Param) *Schema {
+	for _, p := range params {
+		if _, ok := s.fields[p.Field]; !ok {
+			panic("filter: param " + p.Name + " refers to unknown field " + p.Field)
+		}
+	}
+	s.params = append(s.params, params...)
+	return s
+}
+
+func (s *Schema) Field(name string) (Field, bool) {
+	f, ok := s.fields[name]
+	return f, ok
+}
+
+// Condition compares Field with Value. Bound, when set, is the value a range
+// bound was given as before being moved to the edge of the span it stands for;
+// it is what checkBounds compares.
+type Condition struct {
+	Field Field
+	Op    Op
+	Value interface{}
+	Bound interface{}
+}
+
+type Filter []Condition
+
+// Parse reads every field[op]=value argument and the plain parameters declared
+// with WithParams. Other arguments are left to the caller. Conditions are checked
+// to leave a non-empty range on every field.
+func (s *Schema) Parse(args *fasthttp.Args) (Filter, error) {
+	return s.ParseAt(args, time.Now())
+}
+
+// ParseAt is Parse for a request evaluated at now.
+func (s *Schema) ParseAt(args *fasthttp.Args, now time.Time) (Filter, error) {
+	var f Filter
+	var err error
+
+	args.VisitAll(func(key, value []byte) {
+		if err != nil {
+			return
+		}
+
+		name, op, ok := splitKey(string(key))
+		if !ok {
+			return
+		}
+
+		field, known := s.fields[name]
+		if !known {
+			err = fmt.Errorf("%s: unknown filter field", name)
+			return
+		}
+		if !field.allows(op) {
+			err = fmt.Errorf("%s: operator %q is not allowed", name, op)
+			return
+		}
+
+		var conditions Filter
+		conditions, err = conditionsFor(field, op, string(value))
+		if err != nil {
+			err = fmt.Errorf("%s[%s]: %v", name, op, err)
+			return
+		}
+
+		f = append(f, conditions...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range s.params {
+		conditions, err := s.param(p, args, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Name, err)
+		}
+		f = append(f, conditions...)
+	}
+
+	if err := f.checkBounds(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (s *Schema) param(p Param, args *fasthttp.Args, now time.Time) (Filter, error) {
+	field := s.fields[p.Field]
+
+	if p.Op == In {
+		values := args.PeekMulti(p.Name)
+		if len(values) == 0 {
+			return nil, nil
+		}
+		parsed := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			v, err := parseScalar(field, string(value))
+			if err != nil {
+				return nil, err
+			}
+			parsed = append(parsed, v)
+		}
+		return Filter{{Field: field, Op: In, Value: parsed}}, nil
+	}
+
+	value := args.Peek(p.Name)
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	inclusive := string(args.Peek(p.Name+"Inclusive")) == "true"
+	if p.Build != nil {
+		return p.Build(field, string(value), Request{Args: args, Now: now, Inclusive: inclusive})
+	}
+
+	op := p.Op
+	if inclusive && p.Inclusive != "" {
+		op = p.Inclusive
+	}
+	return conditionsFor(field, op, string(value))
+}
+
+// conditionsFor parses the value of field[op]. A time covers a whole second, or
+// a whole day when given as a date, so bounds are compiled to the start or the
+// end of that span: toDate=2017-01-01 with lte takes in the entire day.
+func conditionsFor(field Field, op Op, value string) (Filter, error) {
+	if field.Type != Time || op == In || op == Ne {
+		v, err := parseValue(field, op, value)
+		if err != nil {
+			return nil, err
+		}
+		return Filter{{Field: field, Op: op, Value: v}}, nil
+	}
+
+	start, end, err := ParsePeriod(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case Gt:
+		return Filter{{Field: field, Op: Gte, Value: end, Bound: start}}, nil
+	case Gte:
+		return Filter{{Field: field, Op: Gte, Value: start, Bound: start}}, nil
+	case Lt:
+		return Filter{{Field: field, Op: Lt, Value: start, Bound: start}}, nil
+	case Lte:
+		return Filter{{Field: field, Op: Lt, Value: end, Bound: start}}, nil
+	}
+	return Filter{{Field: field, Op: Gte, Value: start, Bound: start}, {Field: field, Op: Lt, Value: end, Bound: start}}, nil
+}
+
+// checkBounds rejects a filter whose lower bound on a field is above its upper
+// bound, e.g. minMark=4&maxMark=2. Bounds are compared as given, so equal
+// exclusive bounds such as fromDate=2017-01-01&toDate=2017-01-01 are accepted and
+// match nothing.
+func (f Filter) checkBounds() error {
+	lower := make(map[string]Condition)
+	upper := make(map[string]Condition)
+	for _, c := range f {
+		switch c.Op {
+		case Gt, Gte:
+			if l, ok := lower[c.Field.Path]; !ok || Compare(c.bound(), l.bound()) > 0 {
+				lower[c.Field.Path] = c
+			}
+		case Lt, Lte:
+			if u, ok := upper[c.Field.Path]; !ok || Compare(c.bound(), u.bound()) < 0 {
+				upper[c.Field.Path] = c
+			}
+		}
+	}
+
+	for path, l := range lower {
+		if u, ok := upper[path]; ok && Compare(l.bound(), u.bound()) > 0 {
+			return fmt.Errorf("%s: the lower bound must not be greater than the upper bound", l.Field.Name)
+		}
+	}
+	return nil
+}
+
+func (c Condition) bound() interface{} {
+	if c.Bound != nil {
+		return c.Bound
+	}
+	return c.Value
+}
+
+func splitKey(key string) (string, Op, bool) {
+	open := strings.IndexByte(key, '[')
+	if open <= 0 || !strings.HasSuffix(key, "]") {
+		return "", "", false
+	}
+
+	return key[:open], Op(key[open+1 : len(key)-1]), true
+}
+
+func parseValue(field Field, op Op, value string) (interface{}, error) {
+	if op == In {
+		parts := strings.Split(value, ",")
+		values := make([]interface{}, 0, len(parts))
+		for _, part := range parts {
+			v, err := parseScalar(field, part)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+
+	if op == Like {
+		if field.Type != String {
+			return nil, fmt.Errorf("like is only supported on strings")
+		}
+		return value, nil
+	}
+
+	return parseScalar(field, value)
+}
+
+func parseScalar(field Field, value string) (interface{}, error) {
+	v, err := parseType(field, value)
+	if err != nil {
+		return nil, err
+	}
+	if field.Check != nil {
+		if err := field.Check(v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func parseType(field Field, value string) (interface{}, error) {
+	switch field.Type {
+	case Int:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", value)
+		}
+		return v, nil
+	case Float:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return v, nil
+	case Time:
+		return ParseTime(value)
+	}
+
+	if field.Normalize != nil {
+		value = field.Normalize(value)
+	}
+	return value, nil
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// ParseTime accepts a Unix timestamp or an ISO-8601 date, date-time is read as UTC
+// when it has no offset.
+func ParseTime(value string) (int64, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%q is neither a Unix timestamp nor an ISO-8601 date", value)
+}
+
+// ParsePeriod reads a value like ParseTime and returns the seconds it covers as
+// [start, end): the whole day for a date, a single second otherwise.
+func ParsePeriod(value string) (int64, int64, error) {
+	start, err := ParseTime(value)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := time.Parse("2006-01-02", value); err == nil {
+		return start, start + 24*60*60, nil
+	}
+	return start, start + 1, nil
+}
+
+// Split separates the conditions on paths under prefix from the others, e.g. to
+// apply joined fields after a $lookup.
+func (f Filter) Split(prefix string) (Filter, Filter) {
+	var matching, rest Filter
+	for _, c := range f {
+		if strings.HasPrefix(c.Field.Path, prefix) {
+			matching = append(matching, c)
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	return matching, rest
+}
+
+// Mongo compiles the filter to a query document. Conditions with the same
+// operator on the same path, e.g. from mark[gte] and minMark, are all kept under
+// $and.
+func (f Filter) Mongo() bson.M {
+	query := bson.M{}
+	var and []interface{}
+	for _, c := range f {
+		op, value := c.mongo()
+
+		conditions, ok := query[c.Field.Path].(bson.M)
+		if !ok {
+			conditions = bson.M{}
+			query[c.Field.Path] = conditions
+		}
+		if _, taken := conditions[op]; taken {
+			and = append(and, bson.M{c.Field.Path: bson.M{op: value}})
+			continue
+		}
+		conditions[op] = value
+	}
+
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+	return query
+}
+
+func (c Condition) mongo() (string, interface{}) {
+	switch c.Op {
+	case Like:
+		return "$regex", bson.RegEx{Pattern: regexp.QuoteMeta(c.Value.(string)), Options: "i"}
+	case Within:
+		return "$geoWithin", c.Value.(Circle).mongo()
+	}
+	return mongoOps[c.Op], c.Value
+}
+
+// AppendTo adds the compiled filter to an existing query under $and so it never
+// clashes with conditions already set on the same paths.
+func (f Filter) AppendTo(query map[string]interface{}) {
+	if len(f) == 0 {
+		return
+	}
+
+	and, _ := query["$and"].([]interface{})
+	query["$and"] = append(and, f.Mongo())
+}
+
+// Predicate compiles the filter to a function matching documents held in memory.
+// Nested paths are resolved through map[string]interface{} and bson.M values.
+func (f Filter) Predicate() func(doc map[string]interface{}) bool {
+	return func(doc map[string]interface{}) bool {
+		for _, c := range f {
+			if !c.matches(Lookup(doc, c.Field.Path)) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (c Condition) matches(v interface{}) bool {
+	switch c.Op {
+	case Eq:
+		return Compare(v, c.Value) == 0
+	case Ne:
+		return Compare(v, c.Value) != 0
+	case Gt:
+		return Compare(v, c.Value) > 0
+	case Gte:
+		return Compare(v, c.Value) >= 0
+	case Lt:
+		r := Compare(v, c.Value)
+		return r < 0 && r != Incomparable
+	case Lte:
+		r := Compare(v, c.Value)
+		return r <= 0 && r != Incomparable
+	case In:
+		for _, candidate := range c.Value.([]interface{}) {
+			if Compare(v, candidate) == 0 {
+				return true
+			}
+		}
+		return false
+	case Like:
+		s, ok := v.(string)
+		return ok && strings.Contains(strings.ToLower(s), strings.ToLower(c.Value.(string)))
+	case Within:
+		return c.Value.(Circle).contains(v)
+	}
+	return false
+}
+
+// Lookup resolves a dotted path in a document held in memory, nil when it is
+// missing.
+func Lookup(doc map[string]interface{}, path string) interface{} {
+	var current interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		switch m := current.(type) {
+		case map[string]interface{}:
+			current = m[key]
+		case bson.M:
+			current = m[key]
+		default:
+			return nil
+		}
+	}
+	return current
+}
+
+// Incomparable is what Compare returns for values of different kinds.
+const Incomparable = -2
+
+// Compare returns -1, 0 or 1 for numbers of any type or strings, or Incomparable
+// when the values have different kinds.
+func Compare(a, b interface{}) int {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return Incomparable
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+
+	x, ok := a.(string)
+	y, ok2 := b.(string)
+	if !ok || !ok2 {
+		return Incomparable
+	}
+	return strings.Compare(x, y)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,253 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var testSchema = NewSchema(
+	Field{Name: "visited_at", Type: Time, Ops: Range},
+	Field{Name: "mark", Type: Int, Ops: Ordered, Check: func(v interface{}) error {
+		if v.(int64) > 5 {
+			return errorString("above 5")
+		}
+		return nil
+	}},
+	Field{Name: "country", Path: "location.country", Type: String, Ops: Textual, Normalize: strings.ToUpper},
+	Field{Name: "place", Path: "location.place", Type: String, Ops: Textual},
+	Field{Name: "score", Type: Float, Ops: Range},
+).WithParams(
+	Param{Name: "fromDate", Field: "visited_at", Op: Gt, Inclusive: Gte},
+	Param{Name: "toDate", Field: "visited_at", Op: Lt, Inclusive: Lte},
+	Param{Name: "minMark", Field: "mark", Op: Gte},
+	Param{Name: "country", Field: "country", Op: In},
+	Param{Name: "place", Field: "place", Op: Like},
+)
+
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
+
+func args(query string) *fasthttp.Args {
+	a := &fasthttp.Args{}
+	a.Parse(query)
+	return a
+}
+
+const day = 24 * 60 * 60
+
+// 2017-01-01T00:00:00Z
+const newYear = 1483228800
+
+func TestParse(t *testing.T) {
+	mark, _ := testSchema.Field("mark")
+	visitedAt, _ := testSchema.Field("visited_at")
+	country, _ := testSchema.Field("country")
+	place, _ := testSchema.Field("place")
+
+	tests := []struct {
+		query string
+		want  Filter
+	}{
+		{"", nil},
+		{"mark[gte]=3", Filter{{mark, Gte, int64(3), nil}}},
+		{"minMark=3", Filter{{mark, Gte, int64(3), nil}}},
+		{"country[in]=ru,fr", Filter{{country, In, []interface{}{"RU", "FR"}, nil}}},
+		{"country=ru&country=fr", Filter{{country, In, []interface{}{"RU", "FR"}, nil}}},
+		{"place=tower", Filter{{place, Like, "tower", nil}}},
+		{"visited_at[gte]=100", Filter{{visitedAt, Gte, int64(100), int64(100)}}},
+		{"visited_at[gt]=100", Filter{{visitedAt, Gte, int64(101), int64(100)}}},
+		{"visited_at[lte]=100", Filter{{visitedAt, Lt, int64(101), int64(100)}}},
+		{"visited_at[lte]=2017-01-01", Filter{{visitedAt, Lt, int64(newYear + day), int64(newYear)}}},
+		{"visited_at[eq]=2017-01-01", Filter{{visitedAt, Gte, int64(newYear), int64(newYear)}, {visitedAt, Lt, int64(newYear + day), int64(newYear)}}},
+		{"fromDate=2017-01-01", Filter{{visitedAt, Gte, int64(newYear + day), int64(newYear)}}},
+		{"fromDate=2017-01-01&fromDateInclusive=true", Filter{{visitedAt, Gte, int64(newYear), int64(newYear)}}},
+		{"toDate=2017-01-01", Filter{{visitedAt, Lt, int64(newYear), int64(newYear)}}},
+		{"toDate=2017-01-01&toDateInclusive=true", Filter{{visitedAt, Lt, int64(newYear + day), int64(newYear)}}},
+		{"toDate=2017-01-01T12:00:00Z&toDateInclusive=true", Filter{{visitedAt, Lt, int64(newYear + day/2 + 1), int64(newYear + day/2)}}},
+		{"fromDate=2017-01-01&toDate=2017-01-01", Filter{{visitedAt, Gte, int64(newYear + day), int64(newYear)}, {visitedAt, Lt, int64(newYear), int64(newYear)}}},
+		{"visited_at[gt]=1000&visited_at[lt]=1000", Filter{{visitedAt, Gte, int64(1001), int64(1000)}, {visitedAt, Lt, int64(1000), int64(1000)}}},
+		{"mark[gt]=2&mark[lt]=2", Filter{{mark, Gt, int64(2), nil}, {mark, Lt, int64(2), nil}}},
+		{"unrelated=1", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := testSchema.Parse(args(tt.query))
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(stripFuncs(got), stripFuncs(tt.want)) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// stripFuncs drops the function fields of the conditions, which DeepEqual cannot
+// compare.
+func stripFuncs(f Filter) Filter {
+	stripped := make(Filter, len(f))
+	for i, c := range f {
+		c.Field.Normalize, c.Field.Check = nil, nil
+		stripped[i] = c
+	}
+	return stripped
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"unknown[eq]=1", "unknown: unknown filter field"},
+		{"visited_at[ne]=1", `visited_at: operator "ne" is not allowed`},
+		{"mark[eq]=x", `mark[eq]: "x" is not an integer`},
+		{"mark[eq]=6", "mark[eq]: above 5"},
+		{"minMark=6", "minMark: above 5"},
+		{"place[like]=a&score[like]=1", "score: operator \"like\" is not allowed"},
+		{"fromDate=yesterday", "fromDate: \"yesterday\" is neither a Unix timestamp nor an ISO-8601 date"},
+		{"mark[gt]=4&mark[lt]=2", "mark: the lower bound must not be greater than the upper bound"},
+		{"fromDate=2017-01-02&toDate=2017-01-01", "visited_at: the lower bound must not be greater than the upper bound"},
+	}
+
+	for _, tt := range tests {
+		_, err := testSchema.Parse(args(tt.query))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: got error %v, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestParseAtBuild(t *testing.T) {
+	now := time.Unix(newYear, 0)
+	schema := NewSchema(Field{Name: "n", Type: Int}).WithParams(Param{
+		Name:  "since",
+		Field: "n",
+		Build: func(field Field, value string, r Request) (Filter, error) {
+			if !r.Now.Equal(now) || !r.Inclusive || string(r.Args.Peek("other")) != "x" {
+				t.Errorf("unexpected request %+v", r)
+			}
+			return Filter{{Field: field, Op: Eq, Value: value}}, nil
+		},
+	})
+
+	got, err := schema.ParseAt(args("since=7&sinceInclusive=true&other=x"), now)
+	if err != nil || len(got) != 1 || got[0].Value != "7" {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	doc := map[string]interface{}{
+		"mark":       4,
+		"visited_at": int64(newYear),
+		"location": bson.M{
+			"country": "RU",
+			"place":   "Red Square",
+			"point":   Point{Type: "Point", Coordinates: []float64{37.62, 55.75}},
+		},
+	}
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"mark[eq]=4", true},
+		{"mark[ne]=4", false},
+		{"mark[gt]=3&mark[lt]=5", true},
+		{"mark[gte]=5", false},
+		{"mark[in]=1,4", true},
+		{"country=ru", true},
+		{"country=fr&country=de", false},
+		{"place=square", true},
+		{"place=SQUARE", true},
+		{"place=tower", false},
+		{"visited_at[eq]=2017-01-01", true},
+		{"toDate=2017-01-01", false},
+		{"toDate=2017-01-01&toDateInclusive=true", true},
+		{"score[gt]=1", false},
+	}
+
+	for _, tt := range tests {
+		f, err := testSchema.Parse(args(tt.query))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if got := f.Predicate()(doc); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	moscow, _ := NewPoint(55.75, 37.62)
+	within := Field{Name: "near", Path: "location.point"}
+	for radius, want := range map[float64]bool{10: true, 1000: true} {
+		f := Filter{{Field: within, Op: Within, Value: Circle{Center: moscow, Radius: radius}}}
+		if got := f.Predicate()(doc); got != want {
+			t.Errorf("within %vm: got %v, want %v", radius, got, want)
+		}
+	}
+
+	petersburg, _ := NewPoint(59.94, 30.31)
+	f := Filter{{Field: within, Op: Within, Value: Circle{Center: petersburg, Radius: 100000}}}
+	if f.Predicate()(doc) {
+		t.Error("Moscow is not within 100km of Saint Petersburg")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		want int
+	}{
+		{1, 2, -1},
+		{int64(2), 2.0, 0},
+		{uint32(3), int32(2), 1},
+		{"a", "b", -1},
+		{"b", "b", 0},
+		{"1", 1, Incomparable},
+		{1, "1", Incomparable},
+		{nil, 1, Incomparable},
+		{nil, nil, Incomparable},
+	}
+
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%#v, %#v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMongo(t *testing.T) {
+	f, err := testSchema.Parse(args("mark[gte]=2&minMark=3&place=tower&country=ru"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bson.M{
+		"mark":             bson.M{"$gte": int64(2)},
+		"location.place":   bson.M{"$regex": bson.RegEx{Pattern: "tower", Options: "i"}},
+		"location.country": bson.M{"$in": []interface{}{"RU"}},
+		"$and":             []interface{}{bson.M{"mark": bson.M{"$gte": int64(3)}}},
+	}
+	if got := f.Mongo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	f, err := testSchema.Parse(args("mark[eq]=1&country=ru&place=x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, rest := f.Split("location.")
+	if len(location) != 2 || len(rest) != 1 || rest[0].Field.Name != "mark" {
+		t.Errorf("got %v and %v", location, rest)
+	}
+}
@@ -0,0 +1,85 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EarthRadius is the mean radius Mongo uses for spherical geometry, in meters.
+const EarthRadius = 6378100.0
+
+// Point is a GeoJSON point, the shape 2dsphere indexes expect.
+type Point struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// NewPoint validates a latitude and a longitude in degrees.
+func NewPoint(lat, lon float64) (Point, error) {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return Point{}, fmt.Errorf("latitude %v is not between -90 and 90", lat)
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return Point{}, fmt.Errorf("longitude %v is not between -180 and 180", lon)
+	}
+	return Point{Type: "Point", Coordinates: []float64{lon, lat}}, nil
+}
+
+// Circle is the area within Radius meters of Center on the surface of the Earth.
+type Circle struct {
+	Center Point
+	Radius float64
+}
+
+func (c Circle) mongo() bson.M {
+	return bson.M{"$centerSphere": []interface{}{c.Center.Coordinates, c.Radius / EarthRadius}}
+}
+
+// contains reports whether a point decoded into a document lies in the circle.
+func (c Circle) contains(v interface{}) bool {
+	var coordinates interface{}
+	switch p := v.(type) {
+	case map[string]interface{}:
+		coordinates = p["coordinates"]
+	case bson.M:
+		coordinates = p["coordinates"]
+	case Point:
+		coordinates = p.Coordinates
+	}
+
+	var lon, lat float64
+	switch xy := coordinates.(type) {
+	case []float64:
+		if len(xy) != 2 {
+			return false
+		}
+		lon, lat = xy[0], xy[1]
+	case []interface{}:
+		if len(xy) != 2 {
+			return false
+		}
+		x, ok := toFloat(xy[0])
+		y, ok2 := toFloat(xy[1])
+		if !ok || !ok2 {
+			return false
+		}
+		lon, lat = x, y
+	default:
+		return false
+	}
+
+	return Distance(c.Center.Coordinates[1], c.Center.Coordinates[0], lat, lon) <= c.Radius
+}
+
+// Distance is the great-circle distance in meters between two positions given in
+// degrees.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNewPoint(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+		ok       bool
+	}{
+		{55.75, 37.62, true},
+		{0, 0, true},
+		{90, 180, true},
+		{-90, -180, true},
+		{90.5, 0, false},
+		{-91, 0, false},
+		{0, 180.1, false},
+		{0, -181, false},
+		{math.NaN(), 0, false},
+		{0, math.NaN(), false},
+	}
+
+	for _, tt := range tests {
+		p, err := NewPoint(tt.lat, tt.lon)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewPoint(%v, %v): got error %v, want ok %v", tt.lat, tt.lon, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		want := Point{Type: "Point", Coordinates: []float64{tt.lon, tt.lat}}
+		if !reflect.DeepEqual(p, want) {
+			t.Errorf("NewPoint(%v, %v) = %v, want %v", tt.lat, tt.lon, p, want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	degree := EarthRadius * math.Pi / 180
+
+	tests := []struct {
+		lat1, lon1, lat2, lon2 float64
+		want, tolerance        float64
+	}{
+		{55.75, 37.62, 55.75, 37.62, 0, 0},
+		{0, 0, 1, 0, degree, 1e-6},
+		{0, 0, 0, 1, degree, 1e-6},
+		{0, 179.5, 0, -179.5, degree, 1e-6},
+		{60, 0, 60, 1, degree / 2, 1},
+		{0, 0, 0, 180, EarthRadius * math.Pi, 1e-6},
+		{90, 0, -90, 0, EarthRadius * math.Pi, 1e-6},
+		// Moscow to Saint Petersburg.
+		{55.75, 37.62, 59.94, 30.31, 634000, 5000},
+	}
+
+	for _, tt := range tests {
+		got := Distance(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		if math.Abs(got-tt.want) > tt.tolerance {
+			t.Errorf("Distance(%v, %v, %v, %v) = %v, want %v", tt.lat1, tt.lon1, tt.lat2, tt.lon2, got, tt.want)
+		}
+		if back := Distance(tt.lat2, tt.lon2, tt.lat1, tt.lon1); math.Abs(back-got) > 1e-6 {
+			t.Errorf("Distance(%v, %v, %v, %v) = %v one way and %v the other", tt.lat1, tt.lon1, tt.lat2, tt.lon2, got, back)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/agneum/travels/auth"
+	"github.com/agneum/travels/logging"
+	"github.com/agneum/travels/search"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const auditCollection = "audit"
+
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+)
+
+type fieldChange struct {
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
+
+type auditEntry struct {
+	Entity    string                 `json:"entity" bson:"entity"`
+	EntityId  uint32                 `json:"id" bson:"entity_id"`
+	Action    string                 `json:"action" bson:"action"`
+	Changes   map[string]fieldChange `json:"changes" bson:"changes"`
+	At        int64                  `json:"at" bson:"at"`
+	Client    string                 `json:"client" bson:"client"`
+	RequestId string                 `json:"request_id" bson:"request_id"`
+}
+
+// bookkeepingFields are stored with the entities without being part of them.
+var bookkeepingFields = []string{"_id", validFromField, writeTokenField, pointField, search.Field}
+
+// documentFields turns an entity into the field map it is stored as, without
+// the bookkeeping fields.
+func documentFields(doc interface{}) bson.M {
+	fields := bson.M{}
+
+	raw, err := bson.Marshal(doc)
+	if err == nil {
+		err = bson.Unmarshal(raw, &fields)
+	}
+	if err != nil {
+		return bson.M{}
+	}
+
+	for _, name := range bookkeepingFields {
+		delete(fields, name)
+	}
+	return fields
+}
+
+// diffFields lists the fields of after whose value differs from before.
+func diffFields(before, after bson.M) map[string]fieldChange {
+	changes := make(map[string]fieldChange, len(after))
+	for name, value := range after {
+		previous, ok := before[name]
+		if ok && fmt.Sprint(previous) == fmt.Sprint(value) {
+			continue
+		}
+		changes[name] = fieldChange{Before: previous, After: value}
+	}
+	return changes
+}
+
+// recordAudit appends a mutation to the audit collection. A failure is logged
+// rather than reported since the mutation itself has already been applied.
+// Unlike events, entries are not staged before the mutation, so one is lost if
+// the process stops between the two.
+func recordAudit(ctx *routing.Context, db *mgo.Database, entity string, id uint32, action string, before, after bson.M) {
+	saveAudit(db, newAuditEntry(ctx, entity, id, action, before, after))
+}
+
+func newAuditEntry(ctx *routing.Context, entity string, id uint32, action string, before, after bson.M) *auditEntry {
+	return &auditEntry{
+		Entity:    entity,
+		EntityId:  id,
+		Action:    action,
+		Changes:   diffFields(before, after),
+		At:        time.Now().Unix(),
+		Client:    auth.Identity(ctx.RequestCtx),
+		RequestId: utils.RequestId(ctx.RequestCtx),
+	}
+}
+
+// saveAudit inserts audit entries with a single insert.
+func saveAudit(db *mgo.Database, entries ...*auditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	docs := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry
+	}
+
+	err := insert(db.C(auditCollection), docs...)
+	if err != nil {
+		logging.Log(logging.Error, "unable to record audit entries", logging.Fields{
+			"entity":     entries[0].Entity,
+			"id":         entries[0].EntityId,
+			"action":     entries[0].Action,
+			"entries":    len(entries),
+			"request_id": entries[0].RequestId,
+			"error":      err,
+		})
+	}
+}
+
+// GetAudit lists the audit entries of an entity type, optionally narrowed to one
+// id, newest first.
+func GetAudit(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		entity := string(ctx.QueryArgs().Peek("entity"))
+		if entity != "users" && entity != "locations" && entity != "visits" {
+			utils.ResponseWithError(ctx, fmt.Errorf("entity: %q must be users, locations or visits", entity), http.StatusBadRequest)
+			return nil
+		}
+
+		query := bson.M{"entity": entity}
+		if id := ctx.QueryArgs().Peek("id"); len(id) > 0 {
+			entityId, err := utils.ParseIdParameter(string(id))
+			if err != nil {
+				utils.ResponseWithError(ctx, fmt.Errorf("id: %q is not an id", id), http.StatusBadRequest)
+				return nil
+			}
+			query["entity_id"] = entityId
+		}
+
+		limit := 100
+		if l := ctx.QueryArgs().Peek("limit"); len(l) > 0 {
+			n, err := strconv.Atoi(string(l))
+			if err != nil || n <= 0 || n > 1000 {
+				utils.ResponseWithError(ctx, fmt.Errorf("limit: %q must be between 1 and 1000", l), http.StatusBadRequest)
+				return nil
+			}
+			limit = n
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		entries := []auditEntry{}
+		c := session.DB("travels").C(auditCollection)
+		err := findAll(c, query, &entries, limit, "-at", "-_id")
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		response := make(map[string][]auditEntry, 1)
+		response["entries"] = entries
+		data, err := json.Marshal(response)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
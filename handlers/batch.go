@@ -0,0 +1,504 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/filter"
+	"github.com/agneum/travels/logging"
+	"github.com/agneum/travels/search"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type batchOperation struct {
+	Op     string          `json:"op"`
+	Entity string          `json:"entity"`
+	Id     uint32          `json:"id"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type batchResult struct {
+	Index  int    `json:"index"`
+	Id     uint32 `json:"id,omitempty"`
+	Status int    `json:"status"`
+}
+
+type batchWrite struct {
+	index    int
+	entity   string
+	id       uint32
+	newId    *uint32
+	selector bson.M
+	doc      interface{}
+	previous bson.M
+	at       int64
+	intent   *events.Intent
+}
+
+// Batch applies a list of create and update operations in their order, each run
+// of consecutive operations on the same collection going in one bulk write. Ids
+// are allocated, previous versions read and events, revisions and audit entries
+// recorded with one round trip per collection or for the whole batch. With
+// atomic=true any failure stops the batch and reverts the writes already
+// applied; writes that could not be reverted are reported with 500 and fail the
+// whole response. Without it the writes of a run are unordered. Results follow
+// the order of the operations and carry their index.
+func Batch(s *mgo.Session, p *events.Publisher) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		var operations []batchOperation
+		err := json.Unmarshal(ctx.Request.Body(), &operations)
+		if err != nil || len(operations) == 0 {
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		atomic := string(ctx.QueryArgs().Peek("atomic")) == "true"
+
+		session := copySession(s)
+		defer session.Close()
+
+		db := session.DB("travels")
+		previous, err := loadBatchPrevious(db, operations)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		results := make([]batchResult, len(operations))
+		writes := make([]batchWrite, 0, len(operations))
+		failed := false
+
+		for i, op := range operations {
+			write, status := prepareBatchWrite(op, previous[op.Entity])
+			write.index = i
+			results[i] = batchResult{Index: i, Id: write.id, Status: status}
+			if status != http.StatusOK {
+				failed = true
+				continue
+			}
+			writes = append(writes, write)
+		}
+
+		if atomic && failed {
+			abortBatch(results)
+			respondWithBatch(ctx, results, http.StatusOK)
+			return nil
+		}
+
+		intents, err := stageBatch(db, p, writes, results)
+		if err != nil {
+			for _, w := range writes {
+				results[w.index].Status = http.StatusInternalServerError
+			}
+			respondWithBatch(ctx, results, http.StatusOK)
+			return nil
+		}
+		defer intents.Abort()
+
+		code := http.StatusOK
+		applied := make([]batchWrite, 0, len(writes))
+		for start := 0; start < len(writes); {
+			end := start + 1
+			for end < len(writes) && writes[end].entity == writes[start].entity {
+				end++
+			}
+
+			done, ok := runBatchWrites(db.C(writes[start].entity), writes[start:end], results, atomic)
+			applied = append(applied, done...)
+			if atomic && !ok {
+				abortBatch(results)
+				left := rollbackBatch(db, applied)
+				for _, w := range left {
+					results[w.index].Status = http.StatusInternalServerError
+				}
+				if len(left) > 0 {
+					code = http.StatusInternalServerError
+				}
+				applied = left
+				break
+			}
+			start = end
+		}
+
+		sort.Slice(applied, func(i, j int) bool { return applied[i].index < applied[j].index })
+
+		revisions := make([]*revision, 0, len(applied))
+		audit := make([]*auditEntry, 0, len(applied))
+		made := make([]*events.Intent, 0, len(applied))
+		for _, w := range applied {
+			action, fields := w.change()
+			if w.previous == nil {
+				if code == http.StatusOK {
+					results[w.index].Status = http.StatusCreated
+				}
+			} else {
+				revisions = append(revisions, newRevision(ctx, w.entity, w.id, action, w.previous))
+			}
+
+			audit = append(audit, newAuditEntry(ctx, w.entity, w.id, action, w.previous, fields))
+			made = append(made, w.intent)
+		}
+
+		saveRevisions(db, revisions...)
+		saveAudit(db, audit...)
+		notify(made...)
+
+		respondWithBatch(ctx, results, code)
+		return nil
+	}
+}
+
+// loadBatchPrevious reads the documents the update operations replace with one
+// query per collection, by collection and id.
+func loadBatchPrevious(db *mgo.Database, operations []batchOperation) (map[string]map[uint32]bson.M, error) {
+	ids := make(map[string][]uint32, 3)
+	for _, op := range operations {
+		if op.Op == "update" && op.Id != 0 && eventEntities[op.Entity] != "" {
+			ids[op.Entity] = append(ids[op.Entity], op.Id)
+		}
+	}
+
+	previous := make(map[string]map[uint32]bson.M, len(ids))
+	for entity, list := range ids {
+		var docs []bson.M
+		err := findAll(db.C(entity), live(bson.M{"id": bson.M{"$in": list}}), &docs, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		byId := make(map[uint32]bson.M, len(docs))
+		for _, doc := range docs {
+			byId[documentId(doc)] = doc
+		}
+		previous[entity] = byId
+	}
+
+	return previous, nil
+}
+
+// stageBatch allocates the ids of the created documents, one range per
+// collection, and stages the events of every write with a single insert.
+func stageBatch(db *mgo.Database, p *events.Publisher, writes []batchWrite, results []batchResult) (events.Intents, error) {
+	err := assignBatchIds(db, writes)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := make([]events.Event, len(writes))
+	for i, w := range writes {
+		results[w.index].Id = w.id
+		action, fields := w.change()
+		staged[i] = eventFor(w.entity, w.id, action, w.at, w.previous, fields)
+	}
+
+	intents, err := p.StageAll(staged)
+	if err != nil {
+		return nil, err
+	}
+	for i, intent := range intents {
+		writes[i].intent = intent
+		writes[i].stamp(intent.Token())
+	}
+
+	return intents, nil
+}
+
+// assignBatchIds raises each sequence past the ids given by the client and
+// reserves the others as one range.
+func assignBatchIds(db *mgo.Database, writes []batchWrite) error {
+	wanted := make(map[string]int, 3)
+	highest := make(map[string]uint32, 3)
+	for _, w := range writes {
+		switch {
+		case w.newId == nil:
+		case w.id == 0:
+			wanted[w.entity]++
+		case w.id > highest[w.entity]:
+			highest[w.entity] = w.id
+		}
+	}
+
+	for entity, id := range highest {
+		if err := raiseSequence(db, entity, id); err != nil {
+			return err
+		}
+	}
+
+	next := make(map[string]uint32, len(wanted))
+	for entity, n := range wanted {
+		first, err := reserveIds(db, entity, n)
+		if err != nil {
+			return err
+		}
+		next[entity] = first
+	}
+
+	for i := range writes {
+		w := &writes[i]
+		if w.newId == nil || w.id != 0 {
+			continue
+		}
+		w.id = next[w.entity]
+		*w.newId = w.id
+		next[w.entity]++
+	}
+
+	return nil
+}
+
+func prepareBatchWrite(op batchOperation, previous map[uint32]bson.M) (batchWrite, int) {
+	write := batchWrite{entity: op.Entity, id: op.Id}
+
+	switch op.Op {
+	case "create":
+		doc, id, validFrom := newEntity(op.Entity)
+		if doc == nil || doc.UnmarshalJSON(op.Data) != nil {
+			return write, http.StatusBadRequest
+		}
+		if user, ok := doc.(*User); ok {
+			if user.Email == "" {
+				return write, http.StatusBadRequest
+			}
+			user.SearchWords = search.Words(op.Entity, documentFields(user))
+		}
+		if location, ok := doc.(*Location); ok {
+			if location.locate() != nil {
+				return write, http.StatusBadRequest
+			}
+			location.normalize()
+			location.SearchWords = search.Words(op.Entity, documentFields(location))
+		}
+
+		*validFrom = time.Now().Unix()
+		write.at = *validFrom
+		write.id = *id
+		write.newId = id
+		write.doc = doc
+		return write, http.StatusOK
+
+	case "update":
+		doc, _, _ := newEntity(op.Entity)
+		if doc == nil || op.Id == 0 {
+			return write, http.StatusBadRequest
+		}
+
+		var fields map[string]interface{}
+		err := utils.UnmarshalObject(op.Data, &fields)
+		if err != nil {
+			return write, http.StatusBadRequest
+		}
+
+		for _, v := range fields {
+			if v == nil {
+				return write, http.StatusBadRequest
+			}
+		}
+
+		write.previous = previous[op.Id]
+		if write.previous == nil {
+			return write, http.StatusNotFound
+		}
+		if op.Entity == "users" && birthDateUpdate(fields) != nil {
+			return write, http.StatusBadRequest
+		}
+
+		var point *filter.Point
+		if op.Entity == "locations" {
+			point, err = pointUpdate(write.previous, fields)
+			if err != nil {
+				return write, http.StatusBadRequest
+			}
+			normalizeUpdate(write.previous, fields)
+		}
+
+		write.at = time.Now().Unix()
+		change := versioned(fields, write.at, "")
+		if point != nil {
+			change[pointField] = point
+		}
+		if words := searchWordsUpdate(op.Entity, write.previous, fields); words != nil {
+			change[search.Field] = words
+		}
+
+		write.selector = live(bson.M{"id": op.Id})
+		write.doc = setting(change)
+		return write, http.StatusOK
+	}
+
+	return write, http.StatusBadRequest
+}
+
+// stamp stores the token of the event staged for the write along with it.
+func (w batchWrite) stamp(token string) {
+	switch doc := w.doc.(type) {
+	case *User:
+		doc.Token = token
+	case *Location:
+		doc.Token = token
+	case *Visit:
+		doc.Token = token
+	case bson.M:
+		doc["$set"].(bson.M)[writeTokenField] = token
+	}
+}
+
+// change tells whether the write creates or updates its entity, and with which
+// fields.
+func (w batchWrite) change() (string, bson.M) {
+	if w.previous == nil {
+		return auditCreate, documentFields(w.doc)
+	}
+	fields := documentFields(w.doc.(bson.M)["$set"])
+	if unset, ok := w.doc.(bson.M)["$unset"].(bson.M); ok {
+		for name := range unset {
+			fields[name] = nil
+		}
+	}
+	return auditUpdate, fields
+}
+
+func newEntity(collection string) (json.Unmarshaler, *uint32, *int64) {
+	switch collection {
+	case "users":
+		user := &User{}
+		return user, &user.Id, &user.ValidFrom
+	case "locations":
+		location := &Location{}
+		return location, &location.Id, &location.ValidFrom
+	case "visits":
+		visit := &Visit{}
+		return visit, &visit.Id, &visit.ValidFrom
+	}
+
+	return nil, nil, nil
+}
+
+// runBatchWrites executes the writes of one collection and reports which of them
+// were applied.
+func runBatchWrites(c *mgo.Collection, writes []batchWrite, results []batchResult, ordered bool) ([]batchWrite, bool) {
+	if len(writes) == 0 {
+		return nil, true
+	}
+
+	bulk := c.Bulk()
+	if !ordered {
+		bulk.Unordered()
+	}
+
+	for _, w := range writes {
+		if w.selector == nil {
+			bulk.Insert(w.doc)
+		} else {
+			bulk.Update(w.selector, w.doc)
+		}
+	}
+
+	_, err := runBulk(c, bulk)
+	if err == nil {
+		return writes, true
+	}
+
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		for _, w := range writes {
+			results[w.index].Status = http.StatusInternalServerError
+		}
+		return nil, false
+	}
+
+	failedAt := len(writes)
+	for _, ecase := range bulkErr.Cases() {
+		if ecase.Index < 0 {
+			for _, w := range writes {
+				results[w.index].Status = http.StatusInternalServerError
+			}
+			return nil, false
+		}
+		if ecase.Index >= len(writes) {
+			continue
+		}
+
+		status := http.StatusBadRequest
+		if mgo.IsDup(ecase.Err) {
+			status = http.StatusConflict
+		}
+		results[writes[ecase.Index].index].Status = status
+
+		if ecase.Index < failedAt {
+			failedAt = ecase.Index
+		}
+	}
+
+	if !ordered {
+		applied := make([]batchWrite, 0, len(writes))
+		for _, w := range writes {
+			if results[w.index].Status == http.StatusOK {
+				applied = append(applied, w)
+			}
+		}
+		return applied, false
+	}
+
+	if failedAt == len(writes) {
+		return writes, false
+	}
+
+	for _, w := range writes[failedAt+1:] {
+		results[w.index].Status = http.StatusFailedDependency
+	}
+
+	return writes[:failedAt], false
+}
+
+// rollbackBatch reverts applied writes newest first: inserted documents are
+// removed and updated documents are restored from their snapshots. It returns the
+// writes left in place because reverting them failed.
+func rollbackBatch(db *mgo.Database, applied []batchWrite) []batchWrite {
+	var left []batchWrite
+	for i := len(applied) - 1; i >= 0; i-- {
+		w := applied[i]
+		c := db.C(w.entity)
+
+		var err error
+		if w.previous == nil {
+			err = remove(c, bson.M{"id": w.id})
+		} else {
+			err = update(c, w.selector, w.previous)
+		}
+		if err != nil {
+			logging.Log(logging.Error, "unable to roll back batch write", logging.Fields{
+				"entity": w.entity,
+				"id":     w.id,
+				"error":  err,
+			})
+			left = append(left, w)
+		}
+	}
+	return left
+}
+
+func abortBatch(results []batchResult) {
+	for i := range results {
+		if results[i].Status == http.StatusOK {
+			results[i].Status = http.StatusFailedDependency
+		}
+	}
+}
+
+func respondWithBatch(ctx *routing.Context, results []batchResult, code int) {
+	response := make(map[string][]batchResult, 1)
+	response["results"] = results
+	data, err := json.Marshal(response)
+	if err != nil {
+		utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+		return
+	}
+
+	utils.ResponseWithJSON(ctx, data, code)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAbortBatch(t *testing.T) {
+	results := []batchResult{
+		{Index: 0, Status: http.StatusOK},
+		{Index: 1, Status: http.StatusBadRequest},
+		{Index: 2, Status: http.StatusOK},
+		{Index: 3, Status: http.StatusNotFound},
+	}
+	abortBatch(results)
+
+	want := []int{http.StatusFailedDependency, http.StatusBadRequest, http.StatusFailedDependency, http.StatusNotFound}
+	for i, r := range results {
+		if r.Status != want[i] {
+			t.Errorf("%d: got %d, want %d", i, r.Status, want[i])
+		}
+	}
+}
+
+func TestAssignBatchIds(t *testing.T) {
+	db := testDatabase(t)
+	if _, err := reserveIds(db, "users", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	users := make([]User, 4)
+	visit := Visit{}
+	writes := []batchWrite{
+		{entity: "users", newId: &users[0].Id},
+		{entity: "users", id: 20, newId: &users[1].Id},
+		{entity: "visits", newId: &visit.Id},
+		{entity: "users", id: 3},
+		{entity: "users", newId: &users[2].Id},
+		{entity: "users", id: 2, newId: &users[3].Id},
+	}
+	users[1].Id, users[3].Id = 20, 2
+
+	if err := assignBatchIds(db, writes); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []uint32{writes[0].id, writes[1].id, writes[2].id, writes[3].id, writes[4].id, writes[5].id}
+	want := []uint32{21, 20, 1, 3, 22, 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got ids %v, want %v", got, want)
+	}
+	if users[0].Id != 21 || users[2].Id != 22 || visit.Id != 1 {
+		t.Errorf("the documents got ids %d, %d and %d", users[0].Id, users[2].Id, visit.Id)
+	}
+
+	if id, _ := assignId(db, "users", 0); id != 23 {
+		t.Errorf("got %d after the batch, want 23", id)
+	}
+}
+
+func TestRunBatchWrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		ordered bool
+		ids     []uint32
+		ok      bool
+		applied []int
+		status  []int
+	}{
+		{"all applied", true, []uint32{2, 3, 4}, true, []int{0, 1, 2}, []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"partial failure", false, []uint32{2, 1, 3}, false, []int{0, 2}, []int{http.StatusOK, http.StatusConflict, http.StatusOK}},
+		{"atomic failure", true, []uint32{2, 1, 3}, false, []int{0}, []int{http.StatusOK, http.StatusConflict, http.StatusFailedDependency}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDatabase(t)
+			c := db.C("users")
+			if err := c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+				t.Fatal(err)
+			}
+			if err := insert(c, &User{Id: 1, Email: "taken@mail.ru"}); err != nil {
+				t.Fatal(err)
+			}
+
+			writes := make([]batchWrite, len(tt.ids))
+			results := make([]batchResult, len(tt.ids))
+			for i, id := range tt.ids {
+				writes[i] = batchWrite{index: i, entity: "users", id: id, doc: &User{Id: id, Email: "new@mail.ru"}}
+				results[i] = batchResult{Index: i, Id: id, Status: http.StatusOK}
+			}
+
+			applied, ok := runBatchWrites(c, writes, results, tt.ordered)
+			if ok != tt.ok {
+				t.Errorf("got ok %v, want %v", ok, tt.ok)
+			}
+
+			indexes := []int{}
+			for _, w := range applied {
+				indexes = append(indexes, w.index)
+			}
+			if !reflect.DeepEqual(indexes, tt.applied) {
+				t.Errorf("applied %v, want %v", indexes, tt.applied)
+			}
+
+			for i, r := range results {
+				if r.Status != tt.status[i] {
+					t.Errorf("%d: got status %d, want %d", i, r.Status, tt.status[i])
+				}
+			}
+
+			if n, _ := c.Count(); n != 1+len(tt.applied) {
+				t.Errorf("%d users stored, want %d", n, 1+len(tt.applied))
+			}
+		})
+	}
+}
+
+func TestRollbackBatch(t *testing.T) {
+	db := testDatabase(t)
+	c := db.C("users")
+
+	previous := bson.M{"id": 1, "email": "old@mail.ru"}
+	if err := insert(c, previous); err != nil {
+		t.Fatal(err)
+	}
+	if err := update(c, bson.M{"id": 1}, bson.M{"$set": bson.M{"email": "new@mail.ru"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(c, &User{Id: 2, Email: "created@mail.ru"}); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := []batchWrite{
+		{index: 0, entity: "users", id: 1, selector: live(bson.M{"id": 1}), previous: previous},
+		{index: 1, entity: "users", id: 2},
+		{index: 2, entity: "users", id: 3},
+	}
+
+	left := rollbackBatch(db, applied)
+	if len(left) != 1 || left[0].index != 2 {
+		t.Errorf("left %+v, want only the write of the missing user 3", left)
+	}
+
+	var user bson.M
+	if err := c.Find(bson.M{"id": 1}).One(&user); err != nil || user["email"] != "old@mail.ru" {
+		t.Errorf("the update was not reverted: %v, %v", user, err)
+	}
+	if n, _ := c.Find(bson.M{"id": 2}).Count(); n != 0 {
+		t.Error("the insert was not reverted")
+	}
+}
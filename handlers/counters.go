@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"github.com/agneum/travels/metrics"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const countersCollection = "counters"
+
+type counter struct {
+	Collection string `bson:"_id"`
+	Seq        uint32 `bson:"seq"`
+}
+
+// assignId reserves the id of a new document in the collection sequence with a
+// single findAndModify, so no id is handed out twice. A client supplied id only
+// raises the sequence past it and is kept: an id below the sequence may still be
+// free, and the unique id index refuses the insert when it is not.
+func assignId(db *mgo.Database, collection string, id uint32) (uint32, error) {
+	if id != 0 {
+		return id, raiseSequence(db, collection, id)
+	}
+	return reserveIds(db, collection, 1)
+}
+
+// reserveIds allocates n consecutive ids of the collection sequence at once and
+// returns the first of them.
+func reserveIds(db *mgo.Database, collection string, n int) (uint32, error) {
+	seq, err := applyCounter(db, collection, bson.M{"$inc": bson.M{"seq": n}})
+	if err != nil {
+		return 0, err
+	}
+	return seq - uint32(n) + 1, nil
+}
+
+// raiseSequence moves the collection sequence up to a client supplied id so that
+// allocated ids never run into it.
+func raiseSequence(db *mgo.Database, collection string, id uint32) error {
+	_, err := applyCounter(db, collection, bson.M{"$max": bson.M{"seq": id}})
+	return err
+}
+
+func applyCounter(db *mgo.Database, collection string, change bson.M) (uint32, error) {
+	defer metrics.Query(countersCollection)()
+
+	var seq counter
+	_, err := db.C(countersCollection).FindId(collection).Apply(mgo.Change{
+		Update:    change,
+		Upsert:    true,
+		ReturnNew: true,
+	}, &seq)
+	if err != nil {
+		return 0, err
+	}
+	return seq.Seq, nil
+}
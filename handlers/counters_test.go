@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestAssignId(t *testing.T) {
+	db := testDatabase(t)
+
+	tests := []struct {
+		id, want uint32
+	}{
+		{0, 1},
+		{0, 2},
+		{10, 10},
+		{0, 11},
+		{5, 5},
+		{0, 12},
+		{12, 12},
+	}
+
+	for i, tt := range tests {
+		id, err := assignId(db, "users", tt.id)
+		if err != nil || id != tt.want {
+			t.Errorf("%d: assignId(%d) = %d, %v, want %d", i, tt.id, id, err, tt.want)
+		}
+	}
+}
+
+func TestAssignIdBelowSequence(t *testing.T) {
+	db := testDatabase(t)
+	c := db.C("users")
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []uint32{10002, 10001} {
+		assigned, err := assignId(db, "users", id)
+		if err != nil || assigned != id {
+			t.Fatalf("assignId(%d) = %d, %v", id, assigned, err)
+		}
+		if err := insert(c, &User{Id: assigned, Email: "user@mail.ru"}); err != nil {
+			t.Errorf("insert of the free id %d: %v", id, err)
+		}
+	}
+
+	if id, _ := assignId(db, "users", 0); id != 10003 {
+		t.Errorf("got %d after the client ids, want 10003", id)
+	}
+}
+
+func TestAssignIdDuplicate(t *testing.T) {
+	db := testDatabase(t)
+	c := db.C("users")
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := assignId(db, "users", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(c, &User{Id: id, Email: "first@mail.ru"}); err != nil {
+		t.Fatal(err)
+	}
+
+	taken, err := assignId(db, "users", id)
+	if err != nil || taken != id {
+		t.Fatalf("assignId(%d) = %d, %v", id, taken, err)
+	}
+	if err := insert(c, &User{Id: taken, Email: "second@mail.ru"}); !mgo.IsDup(err) {
+		t.Errorf("insert of a taken id: got %v, want a duplicate key error", err)
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/agneum/travels/age"
+	"github.com/agneum/travels/filter"
+	"github.com/agneum/travels/reference"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// countryName resolves a country given by ISO code, name or alias, in any case, to
+// the name locations are stored under.
+func countryName(country string) string {
+	name, _ := reference.NormalizeCountry(country)
+	return name
+}
+
+// cityName resolves a city given by name or alias, in any case, to the name
+// locations are stored under, when that does not depend on the country.
+func cityName(city string) string {
+	return reference.NormalizeCity("", city)
+}
+
+var visitedAtField = filter.Field{Name: "visited_at", Type: filter.Time, Ops: filter.Range}
+
+// dateParams bound visited_at. They are exclusive unless fromDateInclusive or
+// toDateInclusive is set; a date-only bound stands for the whole day.
+var dateParams = []filter.Param{
+	{Name: "fromDate", Field: "visited_at", Op: filter.Gt, Inclusive: filter.Gte},
+	{Name: "toDate", Field: "visited_at", Op: filter.Lt, Inclusive: filter.Lte},
+}
+
+func checkMark(v interface{}) error {
+	if mark := v.(int64); mark < 0 || mark > 5 {
+		return fmt.Errorf("%d is not a mark between 0 and 5", mark)
+	}
+	return nil
+}
+
+func checkGender(v interface{}) error {
+	if g := v.(string); g != "m" && g != "f" {
+		return fmt.Errorf("%q must be either \"m\" or \"f\"", g)
+	}
+	return nil
+}
+
+// ageParam bounds birth_date with fromAge or toAge, ages being counted in full
+// years by the age package at the time of the request. A user matches fromAge
+// when older than it and toAge when younger than it; the *Inclusive parameters
+// also accept users whose birthday of that age is that day. Both are bounded by
+// the age itself, so fromAge=30&toAge=30 is accepted and matches nobody while
+// fromAge above toAge is rejected.
+func ageParam(name string, older bool) filter.Param {
+	return filter.Param{
+		Name:  name,
+		Field: "birth_date",
+		Build: func(field filter.Field, value string, r filter.Request) (filter.Filter, error) {
+			years, err := strconv.Atoi(value)
+			if err != nil || years < 0 {
+				return nil, fmt.Errorf("%q is not a non-negative number of years", value)
+			}
+
+			first, last := age.Turning(years, r.Now)
+			switch {
+			case older && r.Inclusive:
+				return filter.Filter{{Field: field, Op: filter.Lt, Value: last, Bound: first}}, nil
+			case older:
+				return filter.Filter{{Field: field, Op: filter.Lt, Value: first, Bound: first}}, nil
+			case r.Inclusive:
+				return filter.Filter{{Field: field, Op: filter.Gte, Value: first, Bound: first}}, nil
+			}
+			return filter.Filter{{Field: field, Op: filter.Gte, Value: last, Bound: first}}, nil
+		},
+	}
+}
+
+// nearParam keeps the points within radius meters of near=lat,lon.
+var nearParam = filter.Param{
+	Name:  "near",
+	Field: "near",
+	Build: func(field filter.Field, value string, r filter.Request) (filter.Filter, error) {
+		parts := strings.Split(value, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q must be lat,lon", value)
+		}
+
+		lat, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a latitude", parts[0])
+		}
+		lon, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a longitude", parts[1])
+		}
+
+		center, err := filter.NewPoint(lat, lon)
+		if err != nil {
+			return nil, err
+		}
+
+		meters, err := parseRadius(r.Args.Peek("radius"))
+		if err != nil {
+			return nil, err
+		}
+
+		return filter.Filter{{Field: field, Op: filter.Within, Value: filter.Circle{Center: center, Radius: meters}}}, nil
+	},
+}
+
+// coordinates reads a latitude and a longitude from two query parameters.
+func coordinates(ctx *routing.Context, latParam, lonParam string) (filter.Point, error) {
+	lat, err := strconv.ParseFloat(string(ctx.QueryArgs().Peek(latParam)), 64)
+	if err != nil {
+		return filter.Point{}, fmt.Errorf("%s: %q is not a latitude", latParam, ctx.QueryArgs().Peek(latParam))
+	}
+
+	lon, err := strconv.ParseFloat(string(ctx.QueryArgs().Peek(lonParam)), 64)
+	if err != nil {
+		return filter.Point{}, fmt.Errorf("%s: %q is not a longitude", lonParam, ctx.QueryArgs().Peek(lonParam))
+	}
+
+	return filter.NewPoint(lat, lon)
+}
+
+// parseRadius reads the radius parameter in meters.
+func parseRadius(value []byte) (float64, error) {
+	if len(value) == 0 {
+		return 0, errors.New("radius: a number of meters is required")
+	}
+	r, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || r <= 0 {
+		return 0, fmt.Errorf("radius: %q is not a positive number of meters", value)
+	}
+	return r, nil
+}
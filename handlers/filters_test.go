@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/agneum/travels/filter"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAgeParams(t *testing.T) {
+	now := time.Date(2017, 6, 15, 12, 0, 0, 0, time.UTC)
+	// Born on June 15, 1987, one turns 30 on the day of now.
+	turning := time.Date(1987, 6, 15, 0, 0, 0, 0, time.UTC).Unix()
+	day := int64(24 * 60 * 60)
+
+	tests := []struct {
+		query string
+		op    filter.Op
+		value int64
+	}{
+		{"fromAge=30", filter.Lt, turning},
+		{"fromAge=30&fromAgeInclusive=true", filter.Lt, turning + day},
+		{"toAge=30", filter.Gte, turning + day},
+		{"toAge=30&toAgeInclusive=true", filter.Gte, turning},
+	}
+
+	for _, tt := range tests {
+		args := &fasthttp.Args{}
+		args.Parse(tt.query)
+
+		query, err := averageMarkSchema.ParseAt(args, now)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if len(query) != 1 || query[0].Field.Path != "user.birth_date" || query[0].Op != tt.op || query[0].Value != tt.value {
+			t.Errorf("%q: got %v, want %s %d", tt.query, query, tt.op, tt.value)
+		}
+	}
+
+	for _, query := range []string{"fromAge=30&toAge=30", "fromAge=30&toAge=30&fromAgeInclusive=true&toAgeInclusive=true", "fromAge=20&toAge=30"} {
+		args := &fasthttp.Args{}
+		args.Parse(query)
+		if _, err := averageMarkSchema.ParseAt(args, now); err != nil {
+			t.Errorf("%q: %v", query, err)
+		}
+	}
+
+	args := &fasthttp.Args{}
+	args.Parse("fromAge=30&toAge=30")
+	query, _ := averageMarkSchema.ParseAt(args, now)
+	for _, born := range []int64{turning - day, turning, turning + day} {
+		if query.Predicate()(bson.M{"user": bson.M{"birth_date": born}}) {
+			t.Errorf("fromAge=30&toAge=30 matches a user born at %d", born)
+		}
+	}
+
+	for _, query := range []string{"fromAge=-1", "toAge=x", "fromAge=31&toAge=30"} {
+		args := &fasthttp.Args{}
+		args.Parse(query)
+		if _, err := averageMarkSchema.ParseAt(args, now); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+func TestNearParam(t *testing.T) {
+	center, _ := filter.NewPoint(55.75, 37.62)
+
+	tests := []struct {
+		query string
+		want  *filter.Circle
+	}{
+		{"near=55.75,37.62&radius=1000", &filter.Circle{Center: center, Radius: 1000}},
+		{"near=55.75,37.62&radius=0.5", &filter.Circle{Center: center, Radius: 0.5}},
+		{"near=55.75,37.62", nil},
+		{"near=55.75,37.62&radius=0", nil},
+		{"near=55.75&radius=1000", nil},
+		{"near=55.75,37.62,1&radius=1000", nil},
+		{"near=north,37.62&radius=1000", nil},
+		{"near=55.75,east&radius=1000", nil},
+		{"near=95,37.62&radius=1000", nil},
+		{"near=55.75,190&radius=1000", nil},
+	}
+
+	for _, tt := range tests {
+		args := &fasthttp.Args{}
+		args.Parse(tt.query)
+
+		query, err := userVisitsSchema.Parse(args)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if len(query) != 1 || query[0].Field.Path != "location.point" || query[0].Op != filter.Within || !reflect.DeepEqual(query[0].Value, *tt.want) {
+			t.Errorf("%q: got %v, want within %v", tt.query, query, *tt.want)
+		}
+	}
+}
+
+func TestParseRadius(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"1000", 1000, true},
+		{"0.5", 0.5, true},
+		{"1e3", 1000, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"-10", 0, false},
+		{"ten", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRadius([]byte(tt.value))
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRadius(%q) = %v, %v, want %v, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/agneum/travels/importer"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+)
+
+type readiness struct {
+	Store          bool   `json:"store"`
+	Imported       bool   `json:"imported"`
+	IndexesEnsured bool   `json:"indexes_ensured"`
+	ImportError    string `json:"import_error,omitempty"`
+}
+
+type status struct {
+	Version string            `json:"version"`
+	Import  importer.State    `json:"import"`
+	Counts  map[string]int    `json:"counts"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// Healthz only tells that the process is up and serving.
+func Healthz() func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		utils.ResponseWithJSON(ctx, []byte(`{"status":"ok"}`), http.StatusOK)
+		return nil
+	}
+}
+
+// Readyz answers 503 until Mongo is reachable and the import has finished with
+// its indexes in place, and for good when the import failed.
+func Readyz(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		session := copySession(s)
+		defer session.Close()
+
+		state := importer.Status()
+		ready := readiness{
+			Store:          session.Ping() == nil,
+			Imported:       state.Imported,
+			IndexesEnsured: state.IndexesEnsured,
+			ImportError:    state.Error,
+		}
+
+		data, err := json.Marshal(ready)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		code := http.StatusOK
+		if !ready.Store || !state.Ready() {
+			code = http.StatusServiceUnavailable
+		}
+
+		utils.ResponseWithJSON(ctx, data, code)
+		return nil
+	}
+}
+
+// RequireImported answers 503 to writes until the import has finished, so that
+// they can neither take ids of the dataset nor be refused once it is in.
+func RequireImported(ctx *routing.Context) error {
+	if !importer.Status().Ready() {
+		ctx.Response.Header.Set("Retry-After", "5")
+		utils.ResponseWithError(ctx, errors.New("the dataset is still being imported"), http.StatusServiceUnavailable)
+		ctx.Abort()
+	}
+	return nil
+}
+
+// Status reports the build version, the import state and the number of
+// documents per collection.
+func Status(s *mgo.Session, version string) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		session := copySession(s)
+		defer session.Close()
+
+		response := status{
+			Version: version,
+			Import:  importer.Status(),
+			Counts:  make(map[string]int, 3),
+		}
+
+		db := session.DB("travels")
+		for _, collection := range []string{"users", "locations", "visits"} {
+			n, err := countDocs(db.C(collection), nil)
+			if err != nil {
+				if response.Errors == nil {
+					response.Errors = make(map[string]string, 3)
+				}
+				response.Errors[collection] = err.Error()
+				continue
+			}
+			response.Counts[collection] = n
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/agneum/travels/auth"
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/logging"
+	"github.com/agneum/travels/search"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const revisionsCollection = "revisions"
+
+// revision is a version of an entity as it was before an update, a deletion or
+// a restore replaced it.
+type revision struct {
+	Entity     string `json:"-" bson:"entity"`
+	EntityId   uint32 `json:"-" bson:"entity_id"`
+	Action     string `json:"action" bson:"action"`
+	Document   bson.M `json:"document" bson:"document"`
+	Token      string `json:"-" bson:"write_token,omitempty"`
+	ReplacedAt int64  `json:"replaced_at" bson:"replaced_at"`
+	Client     string `json:"client" bson:"client"`
+	RequestId  string `json:"request_id" bson:"request_id"`
+}
+
+// live narrows query to the documents that have not been soft deleted.
+func live(query bson.M) bson.M {
+	query["deleted_at"] = bson.M{"$exists": false}
+	return query
+}
+
+// recordRevision keeps the previous version of an entity. Like recordAudit it
+// only logs a failure since the mutation has already been applied, and the
+// revision is lost if the process stops in between.
+func recordRevision(ctx *routing.Context, db *mgo.Database, entity string, id uint32, action string, previous bson.M) {
+	saveRevisions(db, newRevision(ctx, entity, id, action, previous))
+}
+
+func newRevision(ctx *routing.Context, entity string, id uint32, action string, previous bson.M) *revision {
+	document := make(bson.M, len(previous))
+	for k, v := range previous {
+		document[k] = v
+	}
+	delete(document, "_id")
+	delete(document, search.Field)
+	token, _ := document[writeTokenField].(string)
+	delete(document, writeTokenField)
+
+	return &revision{
+		Entity:     entity,
+		EntityId:   id,
+		Action:     action,
+		Document:   document,
+		Token:      token,
+		ReplacedAt: time.Now().Unix(),
+		Client:     auth.Identity(ctx.RequestCtx),
+		RequestId:  utils.RequestId(ctx.RequestCtx),
+	}
+}
+
+// saveRevisions inserts revisions with a single insert.
+func saveRevisions(db *mgo.Database, revisions ...*revision) {
+	if len(revisions) == 0 {
+		return
+	}
+
+	docs := make([]interface{}, len(revisions))
+	for i, r := range revisions {
+		docs[i] = r
+	}
+
+	err := insert(db.C(revisionsCollection), docs...)
+	if err != nil {
+		logging.Log(logging.Error, "unable to record revisions", logging.Fields{
+			"entity":     revisions[0].Entity,
+			"id":         revisions[0].EntityId,
+			"action":     revisions[0].Action,
+			"revisions":  len(revisions),
+			"request_id": revisions[0].RequestId,
+			"error":      err,
+		})
+	}
+}
+
+// DeleteEntity marks a user, location or visit as deleted. It disappears from
+// reads but stays in the collection so that RestoreEntity can bring it back.
+func DeleteEntity(s *mgo.Session, p *events.Publisher, entity string) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		id, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		db := session.DB("travels")
+		c := db.C(entity)
+
+		previous := bson.M{}
+		err = findOne(c, live(bson.M{"id": id}), &previous)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		now := time.Now().Unix()
+		change := bson.M{"deleted_at": now}
+		intent, err := stage(p, entity, uint32(id), auditDelete, now, previous, change)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+		defer intent.Abort()
+
+		err = update(c, live(bson.M{"id": id}), bson.M{"$set": versioned(change, now, intent.Token())})
+		if err == mgo.ErrNotFound {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		recordRevision(ctx, db, entity, uint32(id), auditDelete, previous)
+		recordAudit(ctx, db, entity, uint32(id), auditDelete, previous, change)
+		notify(intent)
+
+		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
+		return nil
+	}
+}
+
+// RestoreEntity undoes DeleteEntity.
+func RestoreEntity(s *mgo.Session, p *events.Publisher, entity string) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		id, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		db := session.DB("travels")
+		c := db.C(entity)
+
+		deleted := bson.M{"id": id, "deleted_at": bson.M{"$exists": true}}
+		previous := bson.M{}
+		err = findOne(c, deleted, &previous)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		restored := make(bson.M, len(previous))
+		for k, v := range previous {
+			restored[k] = v
+		}
+		delete(restored, "deleted_at")
+
+		now := time.Now().Unix()
+		intent, err := stage(p, entity, uint32(id), auditRestore, now, nil, restored)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+		defer intent.Abort()
+
+		err = update(c, deleted, bson.M{
+			"$unset": bson.M{"deleted_at": ""},
+			"$set":   versioned(nil, now, intent.Token()),
+		})
+		if err == mgo.ErrNotFound {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		recordRevision(ctx, db, entity, uint32(id), auditRestore, previous)
+		recordAudit(ctx, db, entity, uint32(id), auditRestore, previous, bson.M{"deleted_at": nil})
+		notify(intent)
+
+		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
+		return nil
+	}
+}
+
+// GetHistory lists the prior versions of an entity, newest first. Deleted
+// entities keep their history.
+func GetHistory(s *mgo.Session, entity string) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		id, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		limit := 100
+		if l := ctx.QueryArgs().Peek("limit"); len(l) > 0 {
+			n, err := strconv.Atoi(string(l))
+			if err != nil || n <= 0 || n > 1000 {
+				utils.ResponseWithError(ctx, fmt.Errorf("limit: %q must be between 1 and 1000", l), http.StatusBadRequest)
+				return nil
+			}
+			limit = n
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		db := session.DB("travels")
+		count, err := countDocs(db.C(entity), bson.M{"id": id})
+		if err != nil || count == 0 {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		revisions := []revision{}
+		query := bson.M{"entity": entity, "entity_id": id}
+		err = findAll(db.C(revisionsCollection), query, &revisions, limit, "-_id")
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		response := make(map[string][]revision, 1)
+		response["revisions"] = revisions
+		data, err := json.Marshal(response)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/filter"
+	"github.com/agneum/travels/reference"
+	"github.com/agneum/travels/search"
 	"github.com/agneum/travels/utils"
 	routing "github.com/qiangxue/fasthttp-routing"
 	mgo "gopkg.in/mgo.v2"
@@ -15,79 +20,246 @@ import (
 
 //easyjson:json
 type Location struct {
-	Id       uint32 `json:"id"`
-	Place    string `json:"place"`
-	Country  string `json:"country"`
-	City     string `json:"city"`
-	Distance uint32 `json:"distance"`
+	Id          uint32        `json:"id"`
+	Place       string        `json:"place"`
+	Country     string        `json:"country"`
+	CountryCode string        `json:"country_code,omitempty" bson:"country_code,omitempty"`
+	City        string        `json:"city"`
+	Distance    uint32        `json:"distance"`
+	Lat         *float64      `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lon         *float64      `json:"lon,omitempty" bson:"lon,omitempty"`
+	Point       *filter.Point `json:"-" bson:"point,omitempty"`
+	ValidFrom   int64         `json:"-" bson:"valid_from,omitempty"`
+	Token       string        `json:"-" bson:"write_token,omitempty"`
+
+	SearchWords []search.Word `json:"-" bson:"search_words,omitempty"`
 }
 
-func CreateLocation(s *mgo.Session) func(ctx *routing.Context) error {
+// pointField holds the GeoJSON point derived from lat and lon, which the 2dsphere
+// index is built on.
+const pointField = "point"
+
+// locate derives the point of a location from its coordinates. A location has
+// either both lat and lon or none of them.
+func (l *Location) locate() error {
+	if l.Lat == nil && l.Lon == nil {
+		l.Point = nil
+		return nil
+	}
+	if l.Lat == nil || l.Lon == nil {
+		return errors.New("lat and lon must be given together")
+	}
+
+	point, err := filter.NewPoint(*l.Lat, *l.Lon)
+	if err != nil {
+		return err
+	}
+	l.Point = &point
+	return nil
+}
+
+// normalize stores the country and city of a location under their canonical
+// names, along with the ISO code of a known country.
+func (l *Location) normalize() {
+	l.Country, l.CountryCode = reference.NormalizeCountry(l.Country)
+	l.City = reference.NormalizeCity(l.Country, l.City)
+}
+
+// normalizeUpdate does the same for the fields of an update of the previous
+// location. The country code follows the country and is not taken from the
+// client; it is set to nil, to be unset, when the new country is unknown.
+func normalizeUpdate(previous bson.M, fields map[string]interface{}) {
+	delete(fields, "country_code")
+	if country, ok := fields["country"].(string); ok {
+		name, code := reference.NormalizeCountry(country)
+		fields["country"], fields["country_code"] = name, code
+		if code == "" {
+			fields["country_code"] = nil
+		}
+	}
+	if city, ok := fields["city"].(string); ok {
+		country, ok := fields["country"].(string)
+		if !ok {
+			country, _ = previous["country"].(string)
+		}
+		fields["city"] = reference.NormalizeCity(country, city)
+	}
+}
+
+// pointUpdate derives the new point of a location when an update changes lat or
+// lon, nil when it changes neither.
+func pointUpdate(previous bson.M, fields map[string]interface{}) (*filter.Point, error) {
+	_, latChanged := fields["lat"]
+	_, lonChanged := fields["lon"]
+	if !latChanged && !lonChanged {
+		return nil, nil
+	}
+
+	coordinate := func(name string) (float64, error) {
+		v, ok := fields[name]
+		if !ok {
+			v = previous[name]
+		}
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		}
+		return 0, fmt.Errorf("%s: %v is not a coordinate", name, v)
+	}
+
+	lat, err := coordinate("lat")
+	if err != nil {
+		return nil, err
+	}
+	lon, err := coordinate("lon")
+	if err != nil {
+		return nil, err
+	}
+
+	point, err := filter.NewPoint(lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	return &point, nil
+}
+
+func CreateLocation(s *mgo.Session, p *events.Publisher) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		location := &Location{}
 		err := location.UnmarshalJSON(ctx.Request.Body())
 
-		if err != nil || location.Id == 0 {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
-		c := session.DB("travels").C("locations")
-		err = c.Insert(location)
+		err = location.locate()
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+		location.normalize()
+		location.SearchWords = search.Words("locations", documentFields(location))
 
+		db := session.DB("travels")
+		location.ValidFrom = time.Now().Unix()
+		location.Id, err = assignId(db, "locations", location.Id)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
 			return nil
 		}
 
-		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
+		fields := documentFields(location)
+		intent, err := stage(p, "locations", location.Id, auditCreate, location.ValidFrom, nil, fields)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+		defer intent.Abort()
+
+		location.Token = intent.Token()
+		err = insert(db.C("locations"), location)
+
+		if mgo.IsDup(err) {
+			utils.ResponseWithFailure(ctx, err, http.StatusConflict)
+			return nil
+		}
+
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		data, err := location.MarshalJSON()
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		recordAudit(ctx, db, "locations", location.Id, auditCreate, nil, fields)
+		notify(intent)
+
+		ctx.Response.Header.Set("Location", fmt.Sprintf("/locations/%d", location.Id))
+		utils.ResponseWithJSON(ctx, data, http.StatusCreated)
 		return nil
 	}
 }
 
-func UpdateLocation(s *mgo.Session) func(ctx *routing.Context) error {
+func UpdateLocation(s *mgo.Session, p *events.Publisher) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		locationId, err := utils.ParseIdParameter(ctx.Param("id"))
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		c := session.DB("travels").C("locations")
-		count, err := c.Find(bson.M{"id": locationId}).Count()
-		if err != nil || count == 0 {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+		previous := bson.M{}
+		err = findOne(c, live(bson.M{"id": locationId}), &previous)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		var location map[string]interface{}
-		err = bson.UnmarshalJSON([]byte(ctx.Request.Body()), &location)
+		err = utils.UnmarshalObject(ctx.Request.Body(), &location)
 
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
 		for _, v := range location {
 			if v == nil {
-				utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+				utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 				return nil
 			}
 		}
 
-		err = c.Update(bson.M{"id": locationId}, bson.M{"$set": &location})
+		point, err := pointUpdate(previous, location)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+		normalizeUpdate(previous, location)
+
+		now := time.Now().Unix()
+		intent, err := stage(p, "locations", uint32(locationId), auditUpdate, now, previous, location)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+		defer intent.Abort()
+
+		change := versioned(location, now, intent.Token())
+		if point != nil {
+			change[pointField] = point
+		}
+		if words := searchWordsUpdate("locations", previous, location); words != nil {
+			change[search.Field] = words
+		}
+
+		err = update(c, live(bson.M{"id": locationId}), setting(change))
 
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
+		recordRevision(ctx, session.DB("travels"), "locations", uint32(locationId), auditUpdate, previous)
+		recordAudit(ctx, session.DB("travels"), "locations", uint32(locationId), auditUpdate, previous, location)
+		notify(intent)
+
 		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
 		return nil
 	}
@@ -95,7 +267,7 @@ func UpdateLocation(s *mgo.Session) func(ctx *routing.Context) error {
 
 func GetLocation(s *mgo.Session) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		var location Location
@@ -103,19 +275,73 @@ func GetLocation(s *mgo.Session) func(ctx *routing.Context) error {
 
 		locationId, err := utils.ParseIdParameter(ctx.Param("id"))
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
-		err = c.Find(bson.M{"id": locationId}).One(&location)
+		err = findOne(c, live(bson.M{"id": locationId}), &location)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		data, err := location.MarshalJSON()
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
+
+// GetNearLocations lists the locations within radius meters of lat and lon,
+// nearest first.
+func GetNearLocations(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		center, err := coordinates(ctx, "lat", "lon")
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		maxDistance, err := parseRadius(ctx.QueryArgs().Peek("radius"))
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		limit := 100
+		if l := ctx.QueryArgs().Peek("limit"); len(l) > 0 {
+			n, err := strconv.Atoi(string(l))
+			if err != nil || n <= 0 || n > 1000 {
+				utils.ResponseWithError(ctx, fmt.Errorf("limit: %q must be between 1 and 1000", l), http.StatusBadRequest)
+				return nil
+			}
+			limit = n
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		query := live(bson.M{pointField: bson.M{"$nearSphere": bson.M{
+			"$geometry":    center,
+			"$maxDistance": maxDistance,
+		}}})
+
+		locations := []Location{}
+		err = findAll(session.DB("travels").C("locations"), query, &locations, limit)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		response := make(map[string][]Location, 1)
+		response["locations"] = locations
+		data, err := json.Marshal(response)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
 			return nil
 		}
 
@@ -126,46 +352,56 @@ func GetLocation(s *mgo.Session) func(ctx *routing.Context) error {
 
 func GetAverageMark(s *mgo.Session) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		coreFilters, err := getCoreFiltersForAverageMark(ctx)
+		locationId, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		asOf, pointInTime, err := parseAsOf(ctx)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		if pointInTime {
+			query, err := averageMarkSchema.ParseAt(ctx.QueryArgs(), time.Unix(asOf, 0))
+			if err != nil {
+				utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+				return nil
+			}
+
+			session := copySession(s)
+			defer session.Close()
+			return getAverageMarkAsOf(ctx, session.DB("travels"), locationId, asOf, query)
+		}
+
+		coreFilters, userFilters, err := getFiltersForAverageMark(ctx)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
 			return nil
 		}
+		coreFilters["location"] = locationId
 
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		l := session.DB("travels").C("locations")
-		count, err := l.Find(bson.M{"id": coreFilters["location"]}).Count()
+		count, err := countDocs(l, live(bson.M{"id": locationId}))
 		if err != nil || count == 0 {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
-		userFilters, err := getUserFiltersForAverageMark(ctx)
+		joinUsers, err := userStages(session.DB("travels"), coreFilters, userFilters)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(err.Error()), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
 			return nil
 		}
 
 		c := session.DB("travels").C("visits")
 
-		pipeline := make([]bson.M, 0, 5)
-		pipeline = append(pipeline, bson.M{"$match": coreFilters})
-
-		if len(userFilters) > 0 {
-			pipeline = append(pipeline, bson.M{
-				"$lookup": bson.M{
-					"from":         "users",
-					"localField":   "user",
-					"foreignField": "id",
-					"as":           "user",
-				},
-			},
-				bson.M{"$match": userFilters},
-				bson.M{"$unwind": "$user"})
-		}
-
+		pipeline := append([]bson.M{bson.M{"$match": coreFilters}}, joinUsers...)
 		pipeline = append(pipeline, bson.M{"$group": bson.M{
 			"_id": "$location",
 			"avg": bson.M{"$avg": "$mark"},
@@ -173,7 +409,7 @@ func GetAverageMark(s *mgo.Session) func(ctx *routing.Context) error {
 
 		averageMark := bson.M{}
 
-		err = c.Pipe(pipeline).One(&averageMark)
+		err = pipeOne(c, pipeline, &averageMark)
 		if err != nil {
 			utils.ResponseWithJSON(ctx, []byte(fmt.Sprintf("{\"avg\":0.0}")), http.StatusOK)
 			return nil
@@ -184,74 +420,138 @@ func GetAverageMark(s *mgo.Session) func(ctx *routing.Context) error {
 	}
 }
 
-func getCoreFiltersForAverageMark(ctx *routing.Context) (map[string]interface{}, error) {
-	coreFilters := make(map[string]interface{}, 3)
+// getAverageMarkAsOf answers GetAverageMark from the versions of the location,
+// its visits and their users valid at asOf. Ages are counted at asOf too.
+func getAverageMarkAsOf(ctx *routing.Context, db *mgo.Database, locationId uint64, asOf int64, query filter.Filter) error {
+	locations, err := versionsAsOf(db, "locations", filter.Filter{{Field: idField("id"), Op: filter.Eq, Value: int64(locationId)}}, asOf)
+	if err != nil || len(locations) == 0 {
+		utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+		return nil
+	}
 
-	locationId, err := utils.ParseIdParameter(ctx.Param("id"))
+	visits, err := versionsAsOf(db, "visits", filter.Filter{{Field: idField("location"), Op: filter.Eq, Value: int64(locationId)}}, asOf)
 	if err != nil {
-		return nil, err
+		utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+		return nil
+	}
+
+	userIds := make([]interface{}, 0, len(visits))
+	for _, visit := range visits {
+		userIds = append(userIds, visit["user"])
 	}
-	coreFilters["location"] = locationId
+	users, err := versionsAsOf(db, "users", filter.Filter{{Field: idField("id"), Op: filter.In, Value: userIds}}, asOf)
+	if err != nil {
+		utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+		return nil
+	}
+
+	matches := query.Predicate()
+	var sum float64
+	var count int
+	for _, visit := range visits {
+		doc := make(bson.M, len(visit))
+		for k, v := range visit {
+			doc[k] = v
+		}
 
-	visitedAt := make(map[string]int, 2)
+		user, ok := users[asId(visit["user"])]
+		if !ok {
+			continue
+		}
+		doc["user"] = user
 
-	if fromDate := ctx.QueryArgs().Peek("fromDate"); len(fromDate) > 0 {
-		date, err := strconv.Atoi(string(fromDate))
-		if err != nil {
-			return nil, err
+		if !matches(doc) {
+			continue
 		}
-		visitedAt["$gt"] = date
-	}
 
-	if toDate := ctx.QueryArgs().Peek("toDate"); len(toDate) > 0 {
-		date, err := strconv.Atoi(string(toDate))
-		if err != nil {
-			return nil, err
+		switch mark := doc["mark"].(type) {
+		case int:
+			sum += float64(mark)
+		case int64:
+			sum += float64(mark)
+		case float64:
+			sum += mark
+		default:
+			continue
 		}
-		visitedAt["$lt"] = date
+		count++
 	}
 
-	if len(visitedAt) > 0 {
-		coreFilters["visited_at"] = visitedAt
+	if count == 0 {
+		utils.ResponseWithJSON(ctx, []byte("{\"avg\":0.0}"), http.StatusOK)
+		return nil
 	}
 
-	return coreFilters, nil
+	utils.ResponseWithJSON(ctx, []byte(fmt.Sprintf("{\"avg\":%.5f}", sum/float64(count))), http.StatusOK)
+	return nil
 }
 
-func getUserFiltersForAverageMark(ctx *routing.Context) (map[string]interface{}, error) {
-	userFilters := make(map[string]interface{}, 3)
+// averageMarkSchema declares the filters of GetAverageMark, on visits joined with
+// their user.
+var averageMarkSchema = filter.NewSchema(
+	visitedAtField,
+	filter.Field{Name: "mark", Type: filter.Int, Ops: filter.Ordered, Check: checkMark},
+	filter.Field{Name: "gender", Path: "user.gender", Type: filter.String, Ops: []filter.Op{filter.Eq, filter.In}, Check: checkGender},
+	filter.Field{Name: "birth_date", Path: "user.birth_date", Type: filter.Time, Ops: filter.Range},
+).WithParams(dateParams...).WithParams(
+	filter.Param{Name: "gender", Field: "gender", Op: filter.Eq},
+	ageParam("fromAge", true),
+	ageParam("toAge", false),
+)
 
-	if gender := ctx.QueryArgs().Peek("gender"); len(gender) > 0 {
-		g := string(gender)
-		if g != "m" && g != "f" {
-			return nil, errors.New("")
-		}
-		userFilters["user.gender"] = g
+// getFiltersForAverageMark parses the parameters of GetAverageMark into the
+// conditions on the visits, whichever location they belong to, and those on
+// their users joined as user. The latter always leave deleted users out.
+func getFiltersForAverageMark(ctx *routing.Context) (bson.M, bson.M, error) {
+	query, err := averageMarkSchema.Parse(ctx.QueryArgs())
+	if err != nil {
+		return nil, nil, err
 	}
 
-	age := make(map[string]int64, 2)
-	currentTime := time.Now()
+	userQuery, visitQuery := query.Split("user.")
+	visitFilters := live(bson.M{})
+	visitQuery.AppendTo(visitFilters)
+	userFilters := bson.M{"user.deleted_at": bson.M{"$exists": false}}
+	userQuery.AppendTo(userFilters)
 
-	if fromAge := ctx.QueryArgs().Peek("fromAge"); len(fromAge) > 0 {
-		date, err := strconv.Atoi(string(fromAge))
-		if err != nil {
-			return nil, err
-		}
+	return visitFilters, userFilters, nil
+}
 
-		age["$lt"] = currentTime.AddDate(-1*date, 0, 0).Unix()
+// userStages returns the stages joining visits with their user to apply the
+// userFilters of getFiltersForAverageMark. When those only leave deleted users
+// out, the ids of the deleted users are excluded in visitFilters instead and no
+// join is needed.
+func userStages(db *mgo.Database, visitFilters, userFilters bson.M) ([]bson.M, error) {
+	if len(userFilters) > 1 {
+		return []bson.M{
+			bson.M{
+				"$lookup": bson.M{
+					"from":         "users",
+					"localField":   "user",
+					"foreignField": "id",
+					"as":           "user",
+				},
+			},
+			bson.M{"$match": userFilters},
+			bson.M{"$unwind": "$user"},
+		}, nil
 	}
 
-	if toAge := ctx.QueryArgs().Peek("toAge"); len(toAge) > 0 {
-		date, err := strconv.Atoi(string(toAge))
-		if err != nil {
-			return nil, err
-		}
-		age["$gt"] = currentTime.AddDate(-1*date, 0, 0).Unix()
+	var deleted []struct {
+		Id uint32 `bson:"id"`
+	}
+	err := findAll(db.C("users"), bson.M{"deleted_at": bson.M{"$exists": true}}, &deleted, 0)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(age) > 0 {
-		userFilters["user.birth_date"] = age
+	if len(deleted) > 0 {
+		ids := make([]uint32, len(deleted))
+		for i, user := range deleted {
+			ids[i] = user.Id
+		}
+		visitFilters["user"] = bson.M{"$nin": ids}
 	}
 
-	return userFilters, nil
+	return nil, nil
 }
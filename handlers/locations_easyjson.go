@@ -42,10 +42,32 @@ func easyjsonE9bf8de2DecodeGithubComAgneumTravelsHandlers(in *jlexer.Lexer, out
 			out.Place = string(in.String())
 		case "country":
 			out.Country = string(in.String())
+		case "country_code":
+			out.CountryCode = string(in.String())
 		case "city":
 			out.City = string(in.String())
 		case "distance":
 			out.Distance = uint32(in.Uint32())
+		case "lat":
+			if in.IsNull() {
+				in.Skip()
+				out.Lat = nil
+			} else {
+				if out.Lat == nil {
+					out.Lat = new(float64)
+				}
+				*out.Lat = float64(in.Float64())
+			}
+		case "lon":
+			if in.IsNull() {
+				in.Skip()
+				out.Lon = nil
+			} else {
+				if out.Lon == nil {
+					out.Lon = new(float64)
+				}
+				*out.Lon = float64(in.Float64())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -78,6 +100,14 @@ func easyjsonE9bf8de2EncodeGithubComAgneumTravelsHandlers(out *jwriter.Writer, i
 	first = false
 	out.RawString("\"country\":")
 	out.String(string(in.Country))
+	if in.CountryCode != "" {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"country_code\":")
+		out.String(string(in.CountryCode))
+	}
 	if !first {
 		out.RawByte(',')
 	}
@@ -90,6 +120,30 @@ func easyjsonE9bf8de2EncodeGithubComAgneumTravelsHandlers(out *jwriter.Writer, i
 	first = false
 	out.RawString("\"distance\":")
 	out.Uint32(uint32(in.Distance))
+	if in.Lat != nil {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"lat\":")
+		if in.Lat == nil {
+			out.RawString("null")
+		} else {
+			out.Float64(float64(*in.Lat))
+		}
+	}
+	if in.Lon != nil {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"lon\":")
+		if in.Lon == nil {
+			out.RawString("null")
+		} else {
+			out.Float64(float64(*in.Lon))
+		}
+	}
 	out.RawByte('}')
 }
 
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNormalizeUpdate(t *testing.T) {
+	previous := bson.M{"country": "Russia", "country_code": "RU", "city": "Moscow"}
+
+	tests := []struct {
+		fields map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"country": "de", "city": "мюнхен"},
+			map[string]interface{}{"country": "Germany", "country_code": "DE", "city": "Munich"},
+		},
+		{
+			map[string]interface{}{"city": "питер", "country_code": "XX"},
+			map[string]interface{}{"city": "Saint Petersburg"},
+		},
+		{
+			map[string]interface{}{"country": " Atlantis ", "city": "питер"},
+			map[string]interface{}{"country": "Atlantis", "country_code": nil, "city": "Saint Petersburg"},
+		},
+		{
+			map[string]interface{}{"country": "США", "city": "питер"},
+			map[string]interface{}{"country": "United States", "country_code": "US", "city": "питер"},
+		},
+	}
+
+	for _, tt := range tests {
+		normalizeUpdate(previous, tt.fields)
+		if !reflect.DeepEqual(tt.fields, tt.want) {
+			t.Errorf("got %v, want %v", tt.fields, tt.want)
+		}
+	}
+}
+
+func TestSetting(t *testing.T) {
+	got := setting(bson.M{"country": "Atlantis", "country_code": nil, "valid_from": int64(1)})
+	want := bson.M{
+		"$set":   bson.M{"country": "Atlantis", "valid_from": int64(1)},
+		"$unset": bson.M{"country_code": ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := setting(bson.M{"place": "x"}); !reflect.DeepEqual(got, bson.M{"$set": bson.M{"place": "x"}}) {
+		t.Errorf("got %v", got)
+	}
+}
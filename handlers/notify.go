@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/logging"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var eventEntities = map[string]string{
+	"users":     "user",
+	"locations": "location",
+	"visits":    "visit",
+}
+
+var eventActions = map[string]string{
+	auditCreate:  "created",
+	auditUpdate:  "updated",
+	auditDelete:  "deleted",
+	auditRestore: "restored",
+}
+
+// stage records e.g. visit.updated in the outbox before a write made at the Unix
+// time at, with the document as it will be after the write, fields of after set
+// to nil being removed. The write must carry that time as its valid_from.
+func stage(p *events.Publisher, entity string, id uint32, action string, at int64, before, after bson.M) (*events.Intent, error) {
+	e := eventFor(entity, id, action, at, before, after)
+	return p.Stage(e.Type, e.Entity, e.EntityId, e.At, e.Data)
+}
+
+// eventFor builds the event stage records, for writes staged in bulk.
+func eventFor(entity string, id uint32, action string, at int64, before, after bson.M) events.Event {
+	document := make(bson.M, len(before)+len(after))
+	for k, v := range before {
+		document[k] = v
+	}
+	for k, v := range after {
+		if v == nil {
+			delete(document, k)
+			continue
+		}
+		document[k] = v
+	}
+	for _, name := range bookkeepingFields {
+		delete(document, name)
+	}
+
+	return events.Event{
+		Type:     eventEntities[entity] + "." + eventActions[action],
+		Entity:   entity,
+		EntityId: id,
+		Data:     document,
+		At:       at,
+	}
+}
+
+// notify publishes staged events once their writes are made.
+func notify(intents ...*events.Intent) {
+	if err := events.Intents(intents).Commit(); err != nil {
+		logging.Log(logging.Error, "unable to publish event", logging.Fields{"error": err})
+	}
+}
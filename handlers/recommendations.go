@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/agneum/travels/filter"
+	"github.com/agneum/travels/recommend"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type recommendation struct {
+	Location
+	Score float64 `json:"score"`
+}
+
+// MarshalJSON keeps the easyjson encoding of the location and adds the score.
+func (r recommendation) MarshalJSON() ([]byte, error) {
+	location, err := r.Location.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return append(location[:len(location)-1], fmt.Sprintf(`,"score":%.5f}`, r.Score)...), nil
+}
+
+// GetRecommendations suggests locations a user has not visited yet, scored by
+// their similarity to the locations the user marked best. Similarities come from
+// recommend.Precompute; country, fromDistance and toDistance narrow the results.
+func GetRecommendations(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		userId, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		query, err := recommendationsSchema.Parse(ctx.QueryArgs())
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		limit := 10
+		if l := ctx.QueryArgs().Peek("limit"); len(l) > 0 {
+			limit, err = strconv.Atoi(string(l))
+			if err != nil || limit <= 0 || limit > 100 {
+				utils.ResponseWithError(ctx, fmt.Errorf("limit: %q must be between 1 and 100", l), http.StatusBadRequest)
+				return nil
+			}
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		db := session.DB("travels")
+		count, err := countDocs(db.C("users"), live(bson.M{"id": userId}))
+		if err != nil || count == 0 {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		var visits []Visit
+		err = findAll(db.C("visits"), live(bson.M{"user": userId}), &visits, 0)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		scores, err := scoreRecommendations(db, visits)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		candidates := make([]uint32, 0, len(scores))
+		for id := range scores {
+			candidates = append(candidates, id)
+		}
+		candidateFilters := bson.M{"id": bson.M{"$in": candidates}}
+		query.AppendTo(candidateFilters)
+
+		var locations []Location
+		err = findAll(db.C("locations"), live(candidateFilters), &locations, 0)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		recommendations := make([]recommendation, 0, len(locations))
+		for _, location := range locations {
+			recommendations = append(recommendations, recommendation{
+				Location: location,
+				Score:    math.Round(scores[location.Id]*1e5) / 1e5,
+			})
+		}
+
+		sort.Slice(recommendations, func(i, j int) bool {
+			if recommendations[i].Score != recommendations[j].Score {
+				return recommendations[i].Score > recommendations[j].Score
+			}
+			return recommendations[i].Id < recommendations[j].Id
+		})
+		if len(recommendations) > limit {
+			recommendations = recommendations[:limit]
+		}
+
+		response := make(map[string][]recommendation, 1)
+		response["recommendations"] = recommendations
+		data, err := json.Marshal(response)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
+
+// scoreRecommendations sums, for every location the user has not visited, its
+// similarity to each liked location weighted by how much above the bar the mark is.
+func scoreRecommendations(db *mgo.Database, visits []Visit) (map[uint32]float64, error) {
+	weights := likedWeights(visits)
+	if len(weights) == 0 {
+		return map[uint32]float64{}, nil
+	}
+
+	liked := make([]uint32, 0, len(weights))
+	for location := range weights {
+		liked = append(liked, location)
+	}
+
+	var similarities []recommend.Similarity
+	err := findAll(db.C(recommend.Collection), bson.M{"location": bson.M{"$in": liked}}, &similarities, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return scoreNeighbours(visits, weights, similarities), nil
+}
+
+// likedWeights weighs the locations liked in visits, every mark of MinMark or more
+// adding how much above the bar it is plus one.
+func likedWeights(visits []Visit) map[uint32]float64 {
+	weights := make(map[uint32]float64)
+	for _, visit := range visits {
+		if visit.Mark >= recommend.MinMark {
+			weights[visit.Location] += float64(visit.Mark - recommend.MinMark + 1)
+		}
+	}
+	return weights
+}
+
+// scoreNeighbours adds up the weighted similarities of the neighbours of the liked
+// locations, leaving out every location visited at all.
+func scoreNeighbours(visits []Visit, weights map[uint32]float64, similarities []recommend.Similarity) map[uint32]float64 {
+	visited := make(map[uint32]bool, len(visits))
+	for _, visit := range visits {
+		visited[visit.Location] = true
+	}
+
+	scores := make(map[uint32]float64)
+	for _, similarity := range similarities {
+		for _, neighbour := range similarity.Neighbours {
+			if visited[neighbour.Location] {
+				continue
+			}
+			scores[neighbour.Location] += neighbour.Score * weights[similarity.Location]
+		}
+	}
+	return scores
+}
+
+// recommendationsSchema declares the filters narrowing the recommended locations.
+var recommendationsSchema = filter.NewSchema(
+	filter.Field{Name: "distance", Type: filter.Int, Ops: filter.Ordered},
+	filter.Field{Name: "country", Type: filter.String, Ops: filter.Textual, Normalize: countryName},
+).WithParams(
+	filter.Param{Name: "country", Field: "country", Op: filter.In},
+	filter.Param{Name: "fromDistance", Field: "distance", Op: filter.Gt},
+	filter.Param{Name: "toDistance", Field: "distance", Op: filter.Lt},
+)
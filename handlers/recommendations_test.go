@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/agneum/travels/recommend"
+)
+
+func TestLikedWeights(t *testing.T) {
+	got := likedWeights([]Visit{
+		{Location: 1, Mark: 5},
+		{Location: 1, Mark: 4},
+		{Location: 2, Mark: 4},
+		{Location: 3, Mark: 3},
+		{Location: 4, Mark: 0},
+	})
+
+	want := map[uint32]float64{1: 3, 2: 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestScoreNeighbours(t *testing.T) {
+	visits := []Visit{
+		{Location: 1, Mark: 5},
+		{Location: 2, Mark: 4},
+		{Location: 3, Mark: 1},
+	}
+	similarities := []recommend.Similarity{
+		{Location: 1, Neighbours: []recommend.Neighbour{{Location: 2, Score: 0.9}, {Location: 3, Score: 0.8}, {Location: 4, Score: 0.5}, {Location: 5, Score: 0.25}}},
+		{Location: 2, Neighbours: []recommend.Neighbour{{Location: 4, Score: 0.5}}},
+	}
+
+	got := scoreNeighbours(visits, likedWeights(visits), similarities)
+
+	// Visited locations are left out, even the disliked 3.
+	want := map[uint32]float64{4: 0.5*2 + 0.5*1, 5: 0.25 * 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := scoreNeighbours(visits, likedWeights(visits), nil); len(got) != 0 {
+		t.Errorf("without similarities: got %v", got)
+	}
+}
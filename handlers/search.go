@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/agneum/travels/search"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type searchResult struct {
+	Entity   string  `json:"entity"`
+	Id       uint32  `json:"id"`
+	Score    float64 `json:"score"`
+	Document bson.M  `json:"document"`
+}
+
+// Search finds locations by place, city or country and users by name or email.
+// Whole words are matched through the text indexes and the last word of q also
+// as a prefix of the indexed search words, so results show up while it is being
+// typed.
+func Search(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		terms := search.Terms(string(ctx.QueryArgs().Peek("q")))
+		if len(terms) == 0 {
+			utils.ResponseWithError(ctx, errors.New("q: at least one word is required"), http.StatusBadRequest)
+			return nil
+		}
+
+		entities := []string{"locations", "users"}
+		if entity := string(ctx.QueryArgs().Peek("type")); entity != "" {
+			if _, ok := search.Fields[entity]; !ok {
+				utils.ResponseWithError(ctx, fmt.Errorf("type: %q must be locations or users", entity), http.StatusBadRequest)
+				return nil
+			}
+			entities = []string{entity}
+		}
+
+		offset, limit, err := searchPage(ctx)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		var results []searchResult
+		for _, entity := range entities {
+			found, err := searchEntity(session.DB("travels").C(entity), terms, offset+limit)
+			if err != nil {
+				utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+				return nil
+			}
+			results = append(results, found...)
+		}
+
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Score != results[j].Score {
+				return results[i].Score > results[j].Score
+			}
+			if results[i].Entity != results[j].Entity {
+				return results[i].Entity < results[j].Entity
+			}
+			return results[i].Id < results[j].Id
+		})
+
+		if offset > len(results) {
+			offset = len(results)
+		}
+		results = results[offset:]
+		if limit < len(results) {
+			results = results[:limit]
+		}
+
+		response := make(map[string][]searchResult, 1)
+		response["results"] = append([]searchResult{}, results...)
+		data, err := json.Marshal(response)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
+
+func searchPage(ctx *routing.Context) (int, int, error) {
+	offset, limit := 0, 20
+
+	if o := ctx.QueryArgs().Peek("offset"); len(o) > 0 {
+		n, err := strconv.Atoi(string(o))
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset: %q is not a non-negative number", o)
+		}
+		offset = n
+	}
+
+	if l := ctx.QueryArgs().Peek("limit"); len(l) > 0 {
+		n, err := strconv.Atoi(string(l))
+		if err != nil || n <= 0 || n > 100 {
+			return 0, 0, fmt.Errorf("limit: %q must be between 1 and 100", l)
+		}
+		limit = n
+	}
+
+	return offset, limit, nil
+}
+
+// searchEntity collects the limit best documents matching the terms as words and
+// the limit best matching the last term as a word prefix, both ranked by Mongo
+// with ties broken by id so that pages are stable, then ranks them together.
+func searchEntity(c *mgo.Collection, terms []string, limit int) ([]searchResult, error) {
+	var byWords []bson.M
+	err := findText(c, live(bson.M{"$text": bson.M{"$search": strings.Join(terms, " ")}}), &byWords, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(terms[len(terms)-1])}
+	pipeline := []bson.M{
+		bson.M{"$match": live(bson.M{search.Field + ".w": prefix})},
+		bson.M{"$addFields": bson.M{"prefix_score": search.PrefixScoreExpr(terms)}},
+		bson.M{"$sort": bson.D{{Name: "prefix_score", Value: -1}, {Name: "id", Value: 1}}},
+		bson.M{"$limit": limit},
+	}
+
+	var byPrefix []bson.M
+	err = pipeAll(c, pipeline, &byPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[uint32]*searchResult, len(byWords)+len(byPrefix))
+	for _, doc := range append(byWords, byPrefix...) {
+		id := documentId(doc)
+		if _, ok := results[id]; ok {
+			continue
+		}
+
+		score, _ := doc["score"].(float64)
+		delete(doc, "score")
+		delete(doc, "prefix_score")
+
+		results[id] = &searchResult{
+			Entity:   c.Name,
+			Id:       id,
+			Score:    score + search.PrefixScore(search.Words(c.Name, doc), terms),
+			Document: documentFields(doc),
+		}
+	}
+
+	ranked := make([]searchResult, 0, len(results))
+	for _, r := range results {
+		ranked = append(ranked, *r)
+	}
+	return ranked, nil
+}
+
+// searchWordsUpdate derives the new search words of a user or location when an
+// update changes a searchable field, nil when it changes none.
+func searchWordsUpdate(entity string, previous bson.M, fields map[string]interface{}) []search.Word {
+	changed := false
+	for name := range search.Fields[entity] {
+		if _, ok := fields[name]; ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	doc := make(map[string]interface{}, len(previous)+len(fields))
+	for k, v := range previous {
+		doc[k] = v
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	return search.Words(entity, doc)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"github.com/agneum/travels/metrics"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The helpers below are the only place handlers talk to Mongo through, so every
+// call is timed per collection.
+
+func copySession(s *mgo.Session) *mgo.Session {
+	metrics.SessionCopied()
+	return s.Copy()
+}
+
+func findOne(c *mgo.Collection, query interface{}, result interface{}) error {
+	defer metrics.Query(c.Name)()
+	return c.Find(query).One(result)
+}
+
+func findAll(c *mgo.Collection, query interface{}, result interface{}, limit int, sort ...string) error {
+	defer metrics.Query(c.Name)()
+	return c.Find(query).Sort(sort...).Limit(limit).All(result)
+}
+
+func countDocs(c *mgo.Collection, query interface{}) (int, error) {
+	defer metrics.Query(c.Name)()
+	return c.Find(query).Count()
+}
+
+func insert(c *mgo.Collection, docs ...interface{}) error {
+	defer metrics.Query(c.Name)()
+	return c.Insert(docs...)
+}
+
+func update(c *mgo.Collection, selector interface{}, change interface{}) error {
+	defer metrics.Query(c.Name)()
+	return c.Update(selector, change)
+}
+
+func remove(c *mgo.Collection, selector interface{}) error {
+	defer metrics.Query(c.Name)()
+	return c.Remove(selector)
+}
+
+func pipeOne(c *mgo.Collection, pipeline interface{}, result interface{}) error {
+	defer metrics.Query(c.Name)()
+	return c.Pipe(pipeline).One(result)
+}
+
+func pipeAll(c *mgo.Collection, pipeline interface{}, result interface{}) error {
+	defer metrics.Query(c.Name)()
+	return c.Pipe(pipeline).All(result)
+}
+
+func runBulk(c *mgo.Collection, bulk *mgo.Bulk) (*mgo.BulkResult, error) {
+	defer metrics.Query(c.Name)()
+	return bulk.Run()
+}
+
+func findText(c *mgo.Collection, query interface{}, result interface{}, limit int) error {
+	defer metrics.Query(c.Name)()
+	return c.Find(query).Select(bson.M{"score": bson.M{"$meta": "textScore"}}).Sort("$textScore:score", "id").Limit(limit).All(result)
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// testDatabase opens a scratch database on the server TRAVELS_TEST_MONGO points
+// at, dropped when the test ends. Tests needing Mongo are skipped without it.
+func testDatabase(t *testing.T) *mgo.Database {
+	t.Helper()
+
+	addr := os.Getenv("TRAVELS_TEST_MONGO")
+	if addr == "" {
+		t.Skip("TRAVELS_TEST_MONGO is not set")
+	}
+
+	session, err := mgo.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := session.DB("travels_test_" + strings.Map(func(r rune) rune {
+		if r == '/' || r == ' ' || r == '.' {
+			return '_'
+		}
+		return r
+	}, t.Name()))
+	db.DropDatabase()
+
+	t.Cleanup(func() {
+		db.DropDatabase()
+		session.Close()
+	})
+	return db
+}
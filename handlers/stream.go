@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/filter"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	streamKeepAlive    = 15 * time.Second
+	streamWriteTimeout = 10 * time.Second
+)
+
+// JoinVisits republishes the visit events of hub on a hub of its own, each visit
+// joined with its location the way the GetUserVisit pipeline does, so that the
+// location is looked up once per event rather than once per stream. The returned
+// hub closes with hub.
+func JoinVisits(s *mgo.Session, hub *events.Hub) *events.Hub {
+	return joinVisits(hub, func(data bson.M) bson.M {
+		session := copySession(s)
+		defer session.Close()
+
+		return joinLocation(session.DB("travels").C("locations"), data)
+	})
+}
+
+// joinVisits republishes the visit events of hub with their data passed through
+// join, dropping the events join returns nil for.
+func joinVisits(hub *events.Hub, join func(bson.M) bson.M) *events.Hub {
+	joined := events.NewHub()
+	sub := hub.Subscribe(func(e events.Event) bool {
+		return e.Entity == "visits"
+	})
+
+	go func() {
+		defer joined.Close()
+
+		for e := range sub.C {
+			visit := join(e.Data)
+			if visit == nil {
+				continue
+			}
+
+			e.Data = visit
+			joined.Deliver(e)
+		}
+	}()
+
+	return joined
+}
+
+// StreamUserVisits pushes the visits of a user as Server-Sent Events whenever one
+// is created or updated, narrowed by the filters of GetUserVisit. It listens to
+// the hub returned by JoinVisits.
+func StreamUserVisits(s *mgo.Session, hub *events.Hub) func(ctx *routing.Context) error {
+	return streamVisits(s, hub, "users", "user")
+}
+
+// StreamLocationVisits pushes the visits of a location like StreamUserVisits.
+func StreamLocationVisits(s *mgo.Session, hub *events.Hub) func(ctx *routing.Context) error {
+	return streamVisits(s, hub, "locations", "location.id")
+}
+
+func streamVisits(s *mgo.Session, hub *events.Hub, collection, owner string) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		id, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		query, err := userVisitsSchema.Parse(ctx.QueryArgs())
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		session := copySession(s)
+		count, err := countDocs(session.DB("travels").C(collection), live(bson.M{"id": id}))
+		session.Close()
+		if err != nil || count == 0 {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		query = append(query, filter.Condition{
+			Field: idField(owner),
+			Op:    filter.Eq,
+			Value: int64(id),
+		})
+		match := query.Predicate()
+
+		sub := hub.Subscribe(func(e events.Event) bool {
+			return match(e.Data)
+		})
+		conn := ctx.Conn()
+
+		ctx.SetContentType("text/event-stream")
+		ctx.Response.Header.Set("Cache-Control", "no-cache")
+		ctx.Response.Header.Set("X-Accel-Buffering", "no")
+		ctx.SetStatusCode(http.StatusOK)
+
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer sub.Close()
+
+			keepAlive := time.NewTicker(streamKeepAlive)
+			defer keepAlive.Stop()
+
+			w.WriteString("retry: 3000\n\n")
+			for {
+				conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+				if err := w.Flush(); err != nil {
+					return
+				}
+
+				select {
+				case e, ok := <-sub.C:
+					if !ok {
+						return
+					}
+
+					data, err := json.Marshal(flattenVisit(e.Data))
+					if err != nil {
+						continue
+					}
+					fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+
+				case <-keepAlive.C:
+					w.WriteString(": keep-alive\n\n")
+				}
+			}
+		})
+
+		return nil
+	}
+}
+
+// joinLocation joins a visit with its location, nil when the location is gone.
+func joinLocation(locations *mgo.Collection, data bson.M) bson.M {
+	visit := make(bson.M, len(data))
+	for k, v := range data {
+		visit[k] = v
+	}
+
+	location := bson.M{}
+	err := findOne(locations, live(bson.M{"id": visit["location"]}), &location)
+	if err != nil {
+		return nil
+	}
+	visit["location"] = location
+
+	return visit
+}
+
+func flattenVisit(visit bson.M) bson.M {
+	location := visit["location"].(bson.M)
+	return bson.M{
+		"id":         visit["id"],
+		"user":       visit["user"],
+		"mark":       visit["mark"],
+		"visited_at": visit["visited_at"],
+		"location":   location["id"],
+		"city":       location["city"],
+		"place":      location["place"],
+	}
+}
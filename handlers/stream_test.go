@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/agneum/travels/events"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFlattenVisit(t *testing.T) {
+	visit := bson.M{
+		"id":         uint32(1),
+		"user":       uint32(2),
+		"mark":       uint8(5),
+		"visited_at": int64(1000),
+		"valid_from": int64(2000),
+		"location": bson.M{
+			"id":       uint32(3),
+			"city":     "Москва",
+			"place":    "Набережная",
+			"country":  "Россия",
+			"distance": uint32(10),
+		},
+	}
+
+	want := bson.M{
+		"id":         uint32(1),
+		"user":       uint32(2),
+		"mark":       uint8(5),
+		"visited_at": int64(1000),
+		"location":   uint32(3),
+		"city":       "Москва",
+		"place":      "Набережная",
+	}
+	if got := flattenVisit(visit); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJoinVisits(t *testing.T) {
+	hub := events.NewHub()
+	joined := joinVisits(hub, func(data bson.M) bson.M {
+		if data["location"] == uint32(0) {
+			return nil
+		}
+		return bson.M{"id": data["id"], "location": bson.M{"id": data["location"]}}
+	})
+	first := joined.Subscribe(func(events.Event) bool { return true })
+	second := joined.Subscribe(func(events.Event) bool { return true })
+
+	hub.Deliver(events.Event{Id: "1", Entity: "users", Data: bson.M{"id": uint32(1)}})
+	hub.Deliver(events.Event{Id: "2", Entity: "visits", Data: bson.M{"id": uint32(2), "location": uint32(0)}})
+	hub.Deliver(events.Event{Id: "3", Entity: "visits", Data: bson.M{"id": uint32(3), "location": uint32(7)}})
+	hub.Close()
+
+	want := bson.M{"id": uint32(3), "location": bson.M{"id": uint32(7)}}
+	for i, sub := range []*events.Subscription{first, second} {
+		var got []events.Event
+		timeout := time.After(time.Second)
+	receive:
+		for {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					break receive
+				}
+				got = append(got, e)
+			case <-timeout:
+				t.Fatalf("%d: the joined hub did not close with its source", i)
+			}
+		}
+
+		if len(got) != 1 || got[0].Id != "3" || !reflect.DeepEqual(got[0].Data, want) {
+			t.Errorf("%d: got %v, want only event 3 joined with its location", i, got)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/agneum/travels/filter"
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type countrySummary struct {
+	Country       string   `json:"country" bson:"_id"`
+	Visits        int      `json:"visits" bson:"visits"`
+	Cities        int      `json:"cities" bson:"-"`
+	CityNames     []string `json:"-" bson:"cities"`
+	TotalDistance int64    `json:"total_distance" bson:"total_distance"`
+	MaxDistance   int64    `json:"max_distance" bson:"max_distance"`
+	AvgMark       float64  `json:"avg_mark" bson:"avg_mark"`
+	MarkSum       int64    `json:"-" bson:"mark_sum"`
+	FirstVisit    int64    `json:"first_visit" bson:"first_visit"`
+	LastVisit     int64    `json:"last_visit" bson:"last_visit"`
+}
+
+type userSummary struct {
+	Visits        int              `json:"visits"`
+	Countries     int              `json:"countries"`
+	Cities        int              `json:"cities"`
+	TotalDistance int64            `json:"total_distance"`
+	MaxDistance   int64            `json:"max_distance"`
+	AvgMark       float64          `json:"avg_mark"`
+	FirstVisit    *int64           `json:"first_visit"`
+	LastVisit     *int64           `json:"last_visit"`
+	ByCountry     []countrySummary `json:"by_country"`
+}
+
+// summarySchema bounds the visits summed up by GetUserSummary.
+var summarySchema = filter.NewSchema(visitedAtField).WithParams(dateParams...)
+
+// GetUserSummary sums up the visits of a user per country and overall, within
+// fromDate and toDate like GetUserVisit. Deleted users are not found and visits of
+// deleted locations do not count.
+func GetUserSummary(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		userId, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		query, err := summarySchema.Parse(ctx.QueryArgs())
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		db := session.DB("travels")
+		count, err := countDocs(db.C("users"), live(bson.M{"id": userId}))
+		if err != nil || count == 0 {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		visitFilters := live(bson.M{"user": userId})
+		query.AppendTo(visitFilters)
+
+		pipeline := []bson.M{
+			bson.M{"$match": visitFilters},
+			bson.M{
+				"$lookup": bson.M{
+					"from":         "locations",
+					"localField":   "location",
+					"foreignField": "id",
+					"as":           "location",
+				},
+			},
+			bson.M{"$unwind": "$location"},
+			bson.M{"$match": bson.M{"location.deleted_at": bson.M{"$exists": false}}},
+			bson.M{"$group": bson.M{
+				"_id":            "$location.country",
+				"visits":         bson.M{"$sum": 1},
+				"cities":         bson.M{"$addToSet": "$location.city"},
+				"total_distance": bson.M{"$sum": "$location.distance"},
+				"max_distance":   bson.M{"$max": "$location.distance"},
+				"avg_mark":       bson.M{"$avg": "$mark"},
+				"mark_sum":       bson.M{"$sum": "$mark"},
+				"first_visit":    bson.M{"$min": "$visited_at"},
+				"last_visit":     bson.M{"$max": "$visited_at"},
+			}},
+		}
+
+		countries := []countrySummary{}
+		err = pipeAll(db.C("visits"), pipeline, &countries)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		data, err := json.Marshal(summarize(countries))
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
+
+// summarize folds the per-country figures into the overall ones. Cities are told
+// apart by country since names repeat across countries.
+func summarize(countries []countrySummary) userSummary {
+	summary := userSummary{Countries: len(countries), ByCountry: countries}
+
+	var markSum, first, last int64
+	for i := range countries {
+		c := &countries[i]
+		c.Cities = len(c.CityNames)
+		c.AvgMark = math.Round(c.AvgMark*1e5) / 1e5
+
+		summary.Visits += c.Visits
+		summary.Cities += c.Cities
+		summary.TotalDistance += c.TotalDistance
+		if c.MaxDistance > summary.MaxDistance {
+			summary.MaxDistance = c.MaxDistance
+		}
+		markSum += c.MarkSum
+
+		if i == 0 || c.FirstVisit < first {
+			first = c.FirstVisit
+		}
+		if i == 0 || c.LastVisit > last {
+			last = c.LastVisit
+		}
+	}
+
+	if summary.Visits > 0 {
+		summary.FirstVisit, summary.LastVisit = &first, &last
+		summary.AvgMark = math.Round(float64(markSum)/float64(summary.Visits)*1e5) / 1e5
+	}
+
+	sort.Slice(countries, func(i, j int) bool {
+		if countries[i].Visits != countries[j].Visits {
+			return countries[i].Visits > countries[j].Visits
+		}
+		return countries[i].Country < countries[j].Country
+	})
+
+	return summary
+}
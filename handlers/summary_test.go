@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummarize(t *testing.T) {
+	int64p := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		countries []countrySummary
+		want      userSummary
+	}{
+		{
+			[]countrySummary{},
+			userSummary{ByCountry: []countrySummary{}},
+		},
+		{
+			[]countrySummary{
+				{Country: "Russia", Visits: 1, CityNames: []string{"Moscow"}, TotalDistance: 10, MaxDistance: 10,
+					AvgMark: 5, MarkSum: 5, FirstVisit: 300, LastVisit: 300},
+			},
+			userSummary{Visits: 1, Countries: 1, Cities: 1, TotalDistance: 10, MaxDistance: 10, AvgMark: 5,
+				FirstVisit: int64p(300), LastVisit: int64p(300),
+				ByCountry: []countrySummary{
+					{Country: "Russia", Visits: 1, Cities: 1, CityNames: []string{"Moscow"}, TotalDistance: 10, MaxDistance: 10,
+						AvgMark: 5, MarkSum: 5, FirstVisit: 300, LastVisit: 300},
+				}},
+		},
+		{
+			// Both countries have a Springfield, counted once in each. Ties on
+			// visits are ordered by country.
+			[]countrySummary{
+				{Country: "Spain", Visits: 1, CityNames: []string{"Madrid"}, TotalDistance: 5, MaxDistance: 5,
+					AvgMark: 1, MarkSum: 1, FirstVisit: 500, LastVisit: 500},
+				{Country: "United States", Visits: 3, CityNames: []string{"Springfield", "Boston"}, TotalDistance: 60, MaxDistance: 40,
+					AvgMark: 10.0 / 3, MarkSum: 10, FirstVisit: 200, LastVisit: 900},
+				{Country: "Canada", Visits: 1, CityNames: []string{"Springfield"}, TotalDistance: 20, MaxDistance: 20,
+					AvgMark: 2, MarkSum: 2, FirstVisit: 100, LastVisit: 100},
+			},
+			userSummary{Visits: 5, Countries: 3, Cities: 4, TotalDistance: 85, MaxDistance: 40, AvgMark: 2.6,
+				FirstVisit: int64p(100), LastVisit: int64p(900),
+				ByCountry: []countrySummary{
+					{Country: "United States", Visits: 3, Cities: 2, CityNames: []string{"Springfield", "Boston"}, TotalDistance: 60, MaxDistance: 40,
+						AvgMark: 3.33333, MarkSum: 10, FirstVisit: 200, LastVisit: 900},
+					{Country: "Canada", Visits: 1, Cities: 1, CityNames: []string{"Springfield"}, TotalDistance: 20, MaxDistance: 20,
+						AvgMark: 2, MarkSum: 2, FirstVisit: 100, LastVisit: 100},
+					{Country: "Spain", Visits: 1, Cities: 1, CityNames: []string{"Madrid"}, TotalDistance: 5, MaxDistance: 5,
+						AvgMark: 1, MarkSum: 1, FirstVisit: 500, LastVisit: 500},
+				}},
+		},
+	}
+
+	for i, tt := range tests {
+		if got := summarize(tt.countries); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got %+v, want %+v", i, got, tt.want)
+		}
+	}
+}
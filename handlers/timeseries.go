@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	secondsPerDay  = 24 * 60 * 60
+	secondsPerWeek = 7 * secondsPerDay
+)
+
+type timeBucket struct {
+	Key    int64   `json:"-" bson:"_id"`
+	Start  int64   `json:"start" bson:"-"`
+	Visits int     `json:"visits" bson:"visits"`
+	Avg    float64 `json:"avg" bson:"avg"`
+}
+
+// timeBuckets maps an interval to the expression grouping visited_at by it and
+// to the start of a bucket given its key. Days and weeks, which start on Monday,
+// are truncated timestamps; months are counted from year 0 as UTC dates.
+var timeBuckets = map[string]struct {
+	key   interface{}
+	start func(key int64) int64
+}{
+	"day": {
+		key:   bson.M{"$subtract": []interface{}{"$visited_at", bson.M{"$mod": []interface{}{"$visited_at", secondsPerDay}}}},
+		start: func(key int64) int64 { return key },
+	},
+	"week": {
+		key: bson.M{"$subtract": []interface{}{"$visited_at", bson.M{"$mod": []interface{}{
+			bson.M{"$add": []interface{}{"$visited_at", 3 * secondsPerDay}}, secondsPerWeek,
+		}}}},
+		start: func(key int64) int64 { return key },
+	},
+	"month": {
+		key: bson.M{"$let": bson.M{
+			"vars": bson.M{"date": bson.M{"$add": []interface{}{time.Unix(0, 0).UTC(), bson.M{"$multiply": []interface{}{"$visited_at", 1000}}}}},
+			"in": bson.M{"$add": []interface{}{
+				bson.M{"$multiply": []interface{}{bson.M{"$year": "$$date"}, 12}},
+				bson.M{"$subtract": []interface{}{bson.M{"$month": "$$date"}, 1}},
+			}},
+		}},
+		start: func(key int64) int64 {
+			return time.Date(int(key/12), time.Month(key%12+1), 1, 0, 0, 0, 0, time.UTC).Unix()
+		},
+	},
+}
+
+// GetLocationTimeseries counts the visits of a location and averages their marks
+// per day, week or month, under the filters of GetAverageMark. Buckets without
+// visits are left out, and so are the visits of deleted users.
+func GetLocationTimeseries(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		interval := string(ctx.QueryArgs().Peek("interval"))
+		if interval == "" {
+			interval = "day"
+		}
+		buckets, ok := timeBuckets[interval]
+		if !ok {
+			utils.ResponseWithError(ctx, fmt.Errorf("interval: %q must be day, week or month", interval), http.StatusBadRequest)
+			return nil
+		}
+
+		locationId, err := utils.ParseIdParameter(ctx.Param("id"))
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		coreFilters, userFilters, err := getFiltersForAverageMark(ctx)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+		coreFilters["location"] = locationId
+
+		session := copySession(s)
+		defer session.Close()
+
+		l := session.DB("travels").C("locations")
+		count, err := countDocs(l, live(bson.M{"id": locationId}))
+		if err != nil || count == 0 {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		pipeline := []bson.M{
+			bson.M{"$match": coreFilters},
+			bson.M{
+				"$lookup": bson.M{
+					"from":         "users",
+					"localField":   "user",
+					"foreignField": "id",
+					"as":           "user",
+				},
+			},
+			bson.M{"$match": userFilters},
+			bson.M{"$unwind": "$user"},
+			bson.M{"$group": bson.M{
+				"_id":    buckets.key,
+				"visits": bson.M{"$sum": 1},
+				"avg":    bson.M{"$avg": "$mark"},
+			}},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		}
+
+		series := []timeBucket{}
+		err = pipeAll(session.DB("travels").C("visits"), pipeline, &series)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		for i := range series {
+			series[i].Start = buckets.start(series[i].Key)
+			series[i].Avg = math.Round(series[i].Avg*1e5) / 1e5
+		}
+
+		data, err := json.Marshal(bson.M{"interval": interval, "buckets": series})
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
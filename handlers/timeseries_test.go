@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func unix(year int, month time.Month, day, hour, min, sec int) int64 {
+	return time.Date(year, month, day, hour, min, sec, 0, time.UTC).Unix()
+}
+
+// bucketTests gives the day, week and month a visit falls in; weeks start on
+// Monday.
+var bucketTests = []struct {
+	visitedAt        int64
+	day, week, month int64
+}{
+	// A Sunday, in the week started the Monday of the year before.
+	{unix(2017, 1, 1, 12, 0, 0), unix(2017, 1, 1, 0, 0, 0), unix(2016, 12, 26, 0, 0, 0), unix(2017, 1, 1, 0, 0, 0)},
+	{unix(2017, 1, 2, 0, 0, 0), unix(2017, 1, 2, 0, 0, 0), unix(2017, 1, 2, 0, 0, 0), unix(2017, 1, 1, 0, 0, 0)},
+	{unix(2016, 12, 31, 23, 59, 59), unix(2016, 12, 31, 0, 0, 0), unix(2016, 12, 26, 0, 0, 0), unix(2016, 12, 1, 0, 0, 0)},
+	{unix(2017, 2, 28, 23, 59, 59), unix(2017, 2, 28, 0, 0, 0), unix(2017, 2, 27, 0, 0, 0), unix(2017, 2, 1, 0, 0, 0)},
+	{unix(2017, 3, 1, 0, 0, 0), unix(2017, 3, 1, 0, 0, 0), unix(2017, 2, 27, 0, 0, 0), unix(2017, 3, 1, 0, 0, 0)},
+	{unix(2016, 2, 29, 8, 0, 0), unix(2016, 2, 29, 0, 0, 0), unix(2016, 2, 29, 0, 0, 0), unix(2016, 2, 1, 0, 0, 0)},
+	// The epoch was a Thursday.
+	{0, 0, unix(1969, 12, 29, 0, 0, 0), 0},
+}
+
+func TestTimeBucketStart(t *testing.T) {
+	tests := []struct {
+		interval string
+		key      int64
+		want     int64
+	}{
+		{"day", unix(2017, 3, 1, 0, 0, 0), unix(2017, 3, 1, 0, 0, 0)},
+		{"week", unix(2017, 2, 27, 0, 0, 0), unix(2017, 2, 27, 0, 0, 0)},
+		{"month", 1970*12 + 0, 0},
+		{"month", 2016*12 + 1, unix(2016, 2, 1, 0, 0, 0)},
+		{"month", 2016*12 + 11, unix(2016, 12, 1, 0, 0, 0)},
+		{"month", 2017*12 + 0, unix(2017, 1, 1, 0, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		if got := timeBuckets[tt.interval].start(tt.key); got != tt.want {
+			t.Errorf("%s %d: got start %v, want %v", tt.interval, tt.key, time.Unix(got, 0).UTC(), time.Unix(tt.want, 0).UTC())
+		}
+	}
+}
+
+func TestTimeBucketKey(t *testing.T) {
+	db := testDatabase(t)
+	c := db.C("visits")
+
+	for i, tt := range bucketTests {
+		if err := insert(c, bson.M{"id": i, "visited_at": tt.visitedAt}); err != nil {
+			t.Fatal(err)
+		}
+
+		for interval, want := range map[string]int64{"day": tt.day, "week": tt.week, "month": tt.month} {
+			var bucket struct {
+				Key int64 `bson:"key"`
+			}
+			pipeline := []bson.M{
+				bson.M{"$match": bson.M{"id": i}},
+				bson.M{"$project": bson.M{"key": timeBuckets[interval].key}},
+			}
+			if err := pipeOne(c, pipeline, &bucket); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := timeBuckets[interval].start(bucket.Key); got != want {
+				t.Errorf("%s of %v: got %v, want %v", interval, time.Unix(tt.visitedAt, 0).UTC(), time.Unix(got, 0).UTC(), time.Unix(want, 0).UTC())
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/agneum/travels/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type rankedLocation struct {
+	Id      uint32  `json:"id" bson:"_id"`
+	Place   string  `json:"place" bson:"place"`
+	Country string  `json:"country" bson:"country"`
+	City    string  `json:"city" bson:"city"`
+	Avg     float64 `json:"avg" bson:"avg"`
+	Visits  int     `json:"visits" bson:"visits"`
+}
+
+var topLocationsOrder = map[string]bson.D{
+	"avg":    {{Name: "avg", Value: -1}, {Name: "visits", Value: -1}, {Name: "_id", Value: 1}},
+	"visits": {{Name: "visits", Value: -1}, {Name: "avg", Value: -1}, {Name: "_id", Value: 1}},
+}
+
+// GetTopLocations ranks locations by the average mark or the number of their
+// visits, taking the visit and user filters of GetAverageMark plus country and
+// minVisits. Visits of deleted users and deleted locations do not count.
+func GetTopLocations(s *mgo.Session) func(ctx *routing.Context) error {
+	return func(ctx *routing.Context) error {
+		by := string(ctx.QueryArgs().Peek("by"))
+		if by == "" {
+			by = "avg"
+		}
+		order, ok := topLocationsOrder[by]
+		if !ok {
+			utils.ResponseWithError(ctx, fmt.Errorf("by: %q must be avg or visits", by), http.StatusBadRequest)
+			return nil
+		}
+
+		visitFilters, userFilters, err := getFiltersForAverageMark(ctx)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		minVisits := 1
+		if m := ctx.QueryArgs().Peek("minVisits"); len(m) > 0 {
+			minVisits, err = strconv.Atoi(string(m))
+			if err != nil || minVisits < 1 {
+				utils.ResponseWithError(ctx, fmt.Errorf("minVisits: %q is not a positive number", m), http.StatusBadRequest)
+				return nil
+			}
+		}
+
+		limit := 10
+		if l := ctx.QueryArgs().Peek("limit"); len(l) > 0 {
+			limit, err = strconv.Atoi(string(l))
+			if err != nil || limit <= 0 || limit > 100 {
+				utils.ResponseWithError(ctx, fmt.Errorf("limit: %q must be between 1 and 100", l), http.StatusBadRequest)
+				return nil
+			}
+		}
+
+		session := copySession(s)
+		defer session.Close()
+
+		country := string(ctx.QueryArgs().Peek("country"))
+		locations, err := topLocations(session.DB("travels"), visitFilters, userFilters, country, order, minVisits, limit)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		for i := range locations {
+			locations[i].Avg = math.Round(locations[i].Avg*1e5) / 1e5
+		}
+
+		response := make(map[string][]rankedLocation, 1)
+		response["locations"] = locations
+		data, err := json.Marshal(response)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		utils.ResponseWithJSON(ctx, data, http.StatusOK)
+		return nil
+	}
+}
+
+// topLocations ranks the locations of the visits matching visitFilters and
+// userFilters. Visits are narrowed to the locations of country, or those not
+// deleted, by their ids first, so that locations are only joined to the ranked
+// ones and users only when userFilters need them.
+func topLocations(db *mgo.Database, visitFilters, userFilters bson.M, country string, order bson.D, minVisits, limit int) ([]rankedLocation, error) {
+	query := bson.M{"deleted_at": bson.M{"$exists": true}}
+	if country != "" {
+		query = live(bson.M{"country": countryName(country)})
+	}
+
+	var matched []struct {
+		Id uint32 `bson:"id"`
+	}
+	err := findAll(db.C("locations"), query, &matched, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint32, len(matched))
+	for i, location := range matched {
+		ids[i] = location.Id
+	}
+	switch {
+	case country != "":
+		visitFilters["location"] = bson.M{"$in": ids}
+	case len(ids) > 0:
+		visitFilters["location"] = bson.M{"$nin": ids}
+	}
+
+	joinUsers, err := userStages(db, visitFilters, userFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := append([]bson.M{bson.M{"$match": visitFilters}}, joinUsers...)
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{
+			"_id":    "$location",
+			"avg":    bson.M{"$avg": "$mark"},
+			"visits": bson.M{"$sum": 1},
+		}},
+		bson.M{"$match": bson.M{"visits": bson.M{"$gte": minVisits}}},
+		bson.M{"$sort": order},
+		bson.M{"$limit": limit},
+		bson.M{"$lookup": bson.M{
+			"from":         "locations",
+			"localField":   "_id",
+			"foreignField": "id",
+			"as":           "location",
+		}},
+		bson.M{"$unwind": "$location"},
+		bson.M{"$project": bson.M{
+			"avg":     1,
+			"visits":  1,
+			"place":   "$location.place",
+			"country": "$location.country",
+			"city":    "$location.city",
+		}},
+	)
+
+	locations := []rankedLocation{}
+	err = pipeAll(db.C("visits"), pipeline, &locations)
+	return locations, err
+}
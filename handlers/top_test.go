@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTopLocations(t *testing.T) {
+	db := testDatabase(t)
+
+	locations := []interface{}{
+		bson.M{"id": 1, "place": "a", "country": "Russia", "city": "Moscow"},
+		bson.M{"id": 2, "place": "b", "country": "Russia", "city": "Moscow"},
+		bson.M{"id": 3, "place": "c", "country": "Germany", "city": "Berlin"},
+		bson.M{"id": 4, "place": "d", "country": "Russia", "city": "Moscow", "deleted_at": int64(100)},
+	}
+	users := []interface{}{
+		bson.M{"id": 10, "gender": "m"},
+		bson.M{"id": 11, "gender": "f"},
+		bson.M{"id": 12, "gender": "f", "deleted_at": int64(100)},
+	}
+	visits := []interface{}{
+		bson.M{"id": 1, "location": 1, "user": 10, "mark": 5},
+		bson.M{"id": 2, "location": 1, "user": 11, "mark": 3},
+		bson.M{"id": 3, "location": 1, "user": 12, "mark": 1},
+		bson.M{"id": 4, "location": 2, "user": 10, "mark": 4},
+		bson.M{"id": 5, "location": 3, "user": 10, "mark": 2},
+		bson.M{"id": 6, "location": 3, "user": 11, "mark": 2},
+		bson.M{"id": 7, "location": 3, "user": 12, "mark": 5},
+		bson.M{"id": 8, "location": 4, "user": 10, "mark": 5},
+	}
+	for name, docs := range map[string][]interface{}{"locations": locations, "users": users, "visits": visits} {
+		if err := insert(db.C(name), docs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		by        string
+		gender    string
+		country   string
+		minVisits int
+		limit     int
+		want      []rankedLocation
+	}{
+		{"avg", "", "", 1, 10, []rankedLocation{
+			{Id: 1, Place: "a", Country: "Russia", City: "Moscow", Avg: 4, Visits: 2},
+			{Id: 2, Place: "b", Country: "Russia", City: "Moscow", Avg: 4, Visits: 1},
+			{Id: 3, Place: "c", Country: "Germany", City: "Berlin", Avg: 2, Visits: 2},
+		}},
+		{"visits", "", "", 1, 10, []rankedLocation{
+			{Id: 1, Place: "a", Country: "Russia", City: "Moscow", Avg: 4, Visits: 2},
+			{Id: 3, Place: "c", Country: "Germany", City: "Berlin", Avg: 2, Visits: 2},
+			{Id: 2, Place: "b", Country: "Russia", City: "Moscow", Avg: 4, Visits: 1},
+		}},
+		{"avg", "", "", 2, 10, []rankedLocation{
+			{Id: 1, Place: "a", Country: "Russia", City: "Moscow", Avg: 4, Visits: 2},
+			{Id: 3, Place: "c", Country: "Germany", City: "Berlin", Avg: 2, Visits: 2},
+		}},
+		{"avg", "", "", 1, 1, []rankedLocation{
+			{Id: 1, Place: "a", Country: "Russia", City: "Moscow", Avg: 4, Visits: 2},
+		}},
+		{"avg", "", "ru", 1, 10, []rankedLocation{
+			{Id: 1, Place: "a", Country: "Russia", City: "Moscow", Avg: 4, Visits: 2},
+			{Id: 2, Place: "b", Country: "Russia", City: "Moscow", Avg: 4, Visits: 1},
+		}},
+		{"avg", "", "Atlantis", 1, 10, []rankedLocation{}},
+		{"avg", "f", "", 1, 10, []rankedLocation{
+			{Id: 1, Place: "a", Country: "Russia", City: "Moscow", Avg: 3, Visits: 1},
+			{Id: 3, Place: "c", Country: "Germany", City: "Berlin", Avg: 2, Visits: 1},
+		}},
+	}
+
+	for i, tt := range tests {
+		visitFilters := live(bson.M{})
+		userFilters := bson.M{"user.deleted_at": bson.M{"$exists": false}}
+		if tt.gender != "" {
+			userFilters["user.gender"] = tt.gender
+		}
+
+		got, err := topLocations(db, visitFilters, userFilters, tt.country, topLocationsOrder[tt.by], tt.minVisits, tt.limit)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"fmt"
+	"math"
 	"net/http"
+	"time"
 
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/search"
 	"github.com/agneum/travels/utils"
 	routing "github.com/qiangxue/fasthttp-routing"
 	mgo "gopkg.in/mgo.v2"
@@ -16,12 +21,36 @@ type User struct {
 	Firstname string `json:"first_name" bson:"first_name"`
 	Lastname  string `json:"last_name" bson:"last_name"`
 	Gender    string `json:"gender"`
-	Birthdate int32  `json:"birth_date" bson:"birth_date"`
+	Birthdate int64  `json:"birth_date" bson:"birth_date"`
+	ValidFrom int64  `json:"-" bson:"valid_from,omitempty"`
+	Token     string `json:"-" bson:"write_token,omitempty"`
+
+	SearchWords []search.Word `json:"-" bson:"search_words,omitempty"`
+}
+
+// birthDateUpdate keeps birth_date a 64-bit timestamp in an update, JSON numbers
+// being decoded as floats.
+func birthDateUpdate(fields map[string]interface{}) error {
+	v, ok := fields["birth_date"]
+	if !ok {
+		return nil
+	}
+
+	switch n := v.(type) {
+	case int64:
+		return nil
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+			fields["birth_date"] = int64(n)
+			return nil
+		}
+	}
+	return fmt.Errorf("birth_date: %v is not a Unix timestamp", v)
 }
 
 func GetUser(s *mgo.Session) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		var user User
@@ -29,19 +58,19 @@ func GetUser(s *mgo.Session) func(ctx *routing.Context) error {
 
 		userId, err := utils.ParseIdParameter(ctx.Param("id"))
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
-		err = c.Find(bson.M{"id": userId}).One(&user)
+		err = findOne(c, live(bson.M{"id": userId}), &user)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		data, err := user.MarshalJSON()
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
@@ -50,66 +79,127 @@ func GetUser(s *mgo.Session) func(ctx *routing.Context) error {
 	}
 }
 
-func CreateUser(s *mgo.Session) func(ctx *routing.Context) error {
+func CreateUser(s *mgo.Session, p *events.Publisher) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		user := &User{}
 		err := user.UnmarshalJSON(ctx.Request.Body())
 
 		if err != nil || user.Email == "" {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
-		c := session.DB("travels").C("users")
-		err = c.Insert(user)
+		db := session.DB("travels")
+		user.SearchWords = search.Words("users", documentFields(user))
+		user.ValidFrom = time.Now().Unix()
+		user.Id, err = assignId(db, "users", user.Id)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
 
+		fields := documentFields(user)
+		intent, err := stage(p, "users", user.Id, auditCreate, user.ValidFrom, nil, fields)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
 			return nil
 		}
+		defer intent.Abort()
 
-		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
+		user.Token = intent.Token()
+		err = insert(db.C("users"), user)
+
+		if mgo.IsDup(err) {
+			utils.ResponseWithFailure(ctx, err, http.StatusConflict)
+			return nil
+		}
+
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		data, err := user.MarshalJSON()
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		recordAudit(ctx, db, "users", user.Id, auditCreate, nil, fields)
+		notify(intent)
+
+		ctx.Response.Header.Set("Location", fmt.Sprintf("/users/%d", user.Id))
+		utils.ResponseWithJSON(ctx, data, http.StatusCreated)
 		return nil
 	}
 }
 
-func UpdateUser(s *mgo.Session) func(ctx *routing.Context) error {
+func UpdateUser(s *mgo.Session, p *events.Publisher) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		userId, err := utils.ParseIdParameter(ctx.Param("id"))
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		var user map[string]interface{}
-		err = bson.UnmarshalJSON([]byte(ctx.Request.Body()), &user)
+		decodeErr := utils.UnmarshalObject(ctx.Request.Body(), &user)
 
 		c := session.DB("travels").C("users")
-		count, err := c.Find(bson.M{"id": userId}).Count()
-		if err != nil || count == 0 {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+		previous := bson.M{}
+		err = findOne(c, live(bson.M{"id": userId}), &previous)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		if decodeErr != nil {
+			utils.ResponseWithFailure(ctx, decodeErr, http.StatusBadRequest)
 			return nil
 		}
 
 		for _, v := range user {
 			if v == nil {
-				utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+				utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 				return nil
 			}
 		}
 
-		err = c.Update(bson.M{"id": userId}, bson.M{"$set": &user})
+		err = birthDateUpdate(user)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
 
+		now := time.Now().Unix()
+		intent, err := stage(p, "users", uint32(userId), auditUpdate, now, previous, user)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
 			return nil
 		}
+		defer intent.Abort()
+
+		change := versioned(user, now, intent.Token())
+		if words := searchWordsUpdate("users", previous, user); words != nil {
+			change[search.Field] = words
+		}
+
+		err = update(c, live(bson.M{"id": userId}), bson.M{"$set": change})
+
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		recordRevision(ctx, session.DB("travels"), "users", uint32(userId), auditUpdate, previous)
+		recordAudit(ctx, session.DB("travels"), "users", uint32(userId), auditUpdate, previous, user)
+		notify(intent)
 
 		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
 		return nil
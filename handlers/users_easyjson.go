@@ -47,7 +47,7 @@ func easyjson84c0690eDecodeGithubComAgneumTravelsHandlers(in *jlexer.Lexer, out
 		case "gender":
 			out.Gender = string(in.String())
 		case "birth_date":
-			out.Birthdate = int32(in.Int32())
+			out.Birthdate = int64(in.Int64())
 		default:
 			in.SkipRecursive()
 		}
@@ -97,7 +97,7 @@ func easyjson84c0690eEncodeGithubComAgneumTravelsHandlers(out *jwriter.Writer, i
 	}
 	first = false
 	out.RawString("\"birth_date\":")
-	out.Int32(int32(in.Birthdate))
+	out.Int64(int64(in.Birthdate))
 	out.RawByte('}')
 }
 
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/filter"
+	routing "github.com/qiangxue/fasthttp-routing"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// validFromField holds when the stored version of a document was written. Together
+// with the replaced_at of its revisions it tells which version was valid when.
+// Imported documents have none and count as valid from the start.
+const validFromField = "valid_from"
+
+// writeTokenField holds the token of the staged event of the write that stored the
+// version, see events.Intent.
+const writeTokenField = events.TokenField
+
+// versioned returns a copy of fields stamped with the time the new version starts
+// and the token of the event staged for it.
+func versioned(fields map[string]interface{}, at int64, token string) bson.M {
+	stamped := make(bson.M, len(fields)+2)
+	for k, v := range fields {
+		stamped[k] = v
+	}
+	stamped[validFromField] = at
+	if token != "" {
+		stamped[writeTokenField] = token
+	}
+	return stamped
+}
+
+// setting turns a change into an update that sets its fields and unsets those
+// set to nil.
+func setting(change bson.M) bson.M {
+	unset := bson.M{}
+	for name, v := range change {
+		if v == nil {
+			unset[name] = ""
+			delete(change, name)
+		}
+	}
+
+	if len(unset) == 0 {
+		return bson.M{"$set": change}
+	}
+	return bson.M{"$set": change, "$unset": unset}
+}
+
+// parseAsOf reads the asOf parameter as a Unix timestamp or an ISO-8601 date.
+func parseAsOf(ctx *routing.Context) (int64, bool, error) {
+	asOf := ctx.QueryArgs().Peek("asOf")
+	if len(asOf) == 0 {
+		return 0, false, nil
+	}
+
+	at, err := filter.ParseTime(string(asOf))
+	if err != nil {
+		return 0, false, fmt.Errorf("asOf: %v", err)
+	}
+	return at, true, nil
+}
+
+// versionsAsOf returns the documents of entity matching match as they were at
+// asOf, keyed by id. The version of a document valid at asOf is its first
+// revision replaced after asOf or, when there is none, the current document.
+// Documents that did not exist yet or were deleted at asOf are left out.
+func versionsAsOf(db *mgo.Database, entity string, match filter.Filter, asOf int64) (map[uint32]bson.M, error) {
+	var current []bson.M
+	err := findAll(db.C(entity), match.Mongo(), &current, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint32, 0, len(current))
+	for _, doc := range current {
+		ids = append(ids, documentId(doc))
+	}
+
+	inRevision := make(filter.Filter, 0, len(match))
+	for _, c := range match {
+		c.Field.Path = "document." + c.Field.Path
+		inRevision = append(inRevision, c)
+	}
+
+	var revisions []revision
+	query := bson.M{
+		"entity":      entity,
+		"replaced_at": bson.M{"$gt": asOf},
+		"$or": []bson.M{
+			bson.M{"entity_id": bson.M{"$in": ids}},
+			inRevision.Mongo(),
+		},
+	}
+	err = findAll(db.C(revisionsCollection), query, &revisions, 0, "replaced_at", "_id")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[uint32]bson.M, len(current))
+	for _, r := range revisions {
+		if _, ok := versions[r.EntityId]; !ok {
+			versions[r.EntityId] = r.Document
+		}
+	}
+	for _, doc := range current {
+		if _, ok := versions[documentId(doc)]; !ok {
+			versions[documentId(doc)] = doc
+		}
+	}
+
+	matches := match.Predicate()
+	for id, doc := range versions {
+		validFrom := filter.Lookup(doc, validFromField)
+		if !matches(doc) || doc["deleted_at"] != nil || (validFrom != nil && filter.Compare(validFrom, asOf) > 0) {
+			delete(versions, id)
+		}
+	}
+
+	return versions, nil
+}
+
+func documentId(doc bson.M) uint32 {
+	return asId(doc["id"])
+}
+
+// asId reads an id the way it comes back from Mongo into a bson.M.
+func asId(v interface{}) uint32 {
+	switch id := v.(type) {
+	case int:
+		return uint32(id)
+	case int64:
+		return uint32(id)
+	case float64:
+		return uint32(id)
+	}
+	return 0
+}
+
+// idField builds the condition selecting one or several documents by id.
+func idField(path string) filter.Field {
+	return filter.Field{Name: path, Path: path, Type: filter.Int}
+}
+
+// applyStages runs the $sort, $skip, $limit and $project stages of a pipeline on
+// documents held in memory.
+func applyStages(docs []bson.M, stages []bson.M) []bson.M {
+	for _, stage := range stages {
+		switch {
+		case stage["$sort"] != nil:
+			order := stage["$sort"].(bson.D)
+			sort.SliceStable(docs, func(i, j int) bool {
+				for _, key := range order {
+					r := filter.Compare(filter.Lookup(docs[i], key.Name), filter.Lookup(docs[j], key.Name))
+					if r == 0 || r == filter.Incomparable {
+						continue
+					}
+					return r*key.Value.(int) < 0
+				}
+				return false
+			})
+
+		case stage["$skip"] != nil:
+			skip := stage["$skip"].(int)
+			if skip > len(docs) {
+				skip = len(docs)
+			}
+			docs = docs[skip:]
+
+		case stage["$limit"] != nil:
+			if limit := stage["$limit"].(int); limit < len(docs) {
+				docs = docs[:limit]
+			}
+
+		case stage["$project"] != nil:
+			projection := stage["$project"].(bson.M)
+			for i, doc := range docs {
+				projected := make(bson.M, len(projection))
+				for name, value := range projection {
+					switch v := value.(type) {
+					case string:
+						projected[name] = filter.Lookup(doc, v[1:])
+					case int:
+						if v == 1 {
+							projected[name] = doc[name]
+						}
+					}
+				}
+				docs[i] = projected
+			}
+		}
+	}
+
+	return docs
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/agneum/travels/filter"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestVersionsAsOf(t *testing.T) {
+	db := testDatabase(t)
+
+	// 1 was imported and renamed at 200, 2 created at 150, 3 deleted at 200 and
+	// restored at 400, 4 changed gender at 200.
+	current := []interface{}{
+		bson.M{"id": 1, "first_name": "b", "gender": "m", validFromField: int64(200)},
+		bson.M{"id": 2, "first_name": "c", "gender": "m", validFromField: int64(150)},
+		bson.M{"id": 3, "first_name": "d", "gender": "m", validFromField: int64(400)},
+		bson.M{"id": 4, "first_name": "e", "gender": "f", validFromField: int64(200)},
+	}
+	revisions := []interface{}{
+		&revision{Entity: "users", EntityId: 1, Action: auditUpdate, ReplacedAt: 200,
+			Document: bson.M{"id": 1, "first_name": "a", "gender": "m"}},
+		&revision{Entity: "users", EntityId: 3, Action: auditDelete, ReplacedAt: 200,
+			Document: bson.M{"id": 3, "first_name": "d", "gender": "m"}},
+		&revision{Entity: "users", EntityId: 3, Action: auditRestore, ReplacedAt: 400,
+			Document: bson.M{"id": 3, "first_name": "d", "gender": "m", "deleted_at": int64(200), validFromField: int64(200)}},
+		&revision{Entity: "users", EntityId: 4, Action: auditUpdate, ReplacedAt: 200,
+			Document: bson.M{"id": 4, "first_name": "e", "gender": "m"}},
+	}
+	if err := insert(db.C("users"), current...); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(db.C(revisionsCollection), revisions...); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := filter.Filter{{Field: idField("id"), Op: filter.In, Value: []interface{}{1, 2, 3, 4}}}
+	men := filter.Filter{{Field: filter.Field{Name: "gender", Path: "gender", Type: filter.String}, Op: filter.Eq, Value: "m"}}
+
+	tests := []struct {
+		asOf  int64
+		match filter.Filter
+		want  map[uint32]string
+	}{
+		{100, ids, map[uint32]string{1: "a", 3: "d", 4: "e"}},
+		{150, ids, map[uint32]string{1: "a", 2: "c", 3: "d", 4: "e"}},
+		{200, ids, map[uint32]string{1: "b", 2: "c", 4: "e"}},
+		{300, ids, map[uint32]string{1: "b", 2: "c", 4: "e"}},
+		{400, ids, map[uint32]string{1: "b", 2: "c", 3: "d", 4: "e"}},
+		{100, men, map[uint32]string{1: "a", 3: "d", 4: "e"}},
+		{300, men, map[uint32]string{1: "b", 2: "c"}},
+	}
+
+	for _, tt := range tests {
+		versions, err := versionsAsOf(db, "users", tt.match, tt.asOf)
+		if err != nil {
+			t.Fatalf("%d %v: %v", tt.asOf, tt.match, err)
+		}
+
+		got := make(map[uint32]string, len(versions))
+		for id, doc := range versions {
+			got[id], _ = doc["first_name"].(string)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d %v: got %v, want %v", tt.asOf, tt.match, got, tt.want)
+		}
+	}
+}
+
+func TestApplyStages(t *testing.T) {
+	docs := func() []bson.M {
+		return []bson.M{
+			{"id": 1, "mark": 3, "location": bson.M{"place": "b"}},
+			{"id": 2, "mark": 5, "location": bson.M{"place": "a"}},
+			{"id": 3, "mark": 3, "location": bson.M{"place": "c"}},
+			{"id": 4, "mark": 1, "location": bson.M{"place": "d"}},
+		}
+	}
+
+	tests := []struct {
+		stages []bson.M
+		want   []int
+	}{
+		{nil, []int{1, 2, 3, 4}},
+		{[]bson.M{{"$sort": bson.D{{Name: "mark", Value: 1}}}}, []int{4, 1, 3, 2}},
+		{[]bson.M{{"$sort": bson.D{{Name: "mark", Value: -1}, {Name: "id", Value: -1}}}}, []int{2, 3, 1, 4}},
+		{[]bson.M{{"$sort": bson.D{{Name: "location.place", Value: 1}}}}, []int{2, 1, 3, 4}},
+		{[]bson.M{{"$skip": 1}, {"$limit": 2}}, []int{2, 3}},
+		{[]bson.M{{"$skip": 10}}, []int{}},
+		{[]bson.M{{"$limit": 10}}, []int{1, 2, 3, 4}},
+		{[]bson.M{{"$sort": bson.D{{Name: "mark", Value: 1}}}, {"$skip": 1}, {"$limit": 2}}, []int{1, 3}},
+	}
+
+	for i, tt := range tests {
+		got := []int{}
+		for _, doc := range applyStages(docs(), tt.stages) {
+			got = append(got, doc["id"].(int))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestApplyStagesProject(t *testing.T) {
+	docs := []bson.M{
+		{"id": 1, "mark": 3, "user": 7, "location": bson.M{"place": "b"}},
+	}
+	project := bson.M{"$project": bson.M{"mark": 1, "user": 0, "place": "$location.place"}}
+
+	got := applyStages(docs, []bson.M{project})
+	want := []bson.M{{"mark": 3, "place": "b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -2,9 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/agneum/travels/events"
+	"github.com/agneum/travels/filter"
 	"github.com/agneum/travels/utils"
 	routing "github.com/qiangxue/fasthttp-routing"
 	mgo "gopkg.in/mgo.v2"
@@ -18,74 +24,120 @@ type Visit struct {
 	User      uint32 `json:"user"`
 	VisitedAt uint32 `json:"visited_at" bson:"visited_at"`
 	Mark      uint8  `json:"mark"`
+	ValidFrom int64  `json:"-" bson:"valid_from,omitempty"`
+	Token     string `json:"-" bson:"write_token,omitempty"`
 }
 
-func CreateVisit(s *mgo.Session) func(ctx *routing.Context) error {
+func CreateVisit(s *mgo.Session, p *events.Publisher) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		visit := &Visit{}
 		err := visit.UnmarshalJSON(ctx.Request.Body())
 
-		if err != nil || visit.Id == 0 {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
-		c := session.DB("travels").C("visits")
-		err = c.Insert(visit)
+		db := session.DB("travels")
+		visit.ValidFrom = time.Now().Unix()
+		visit.Id, err = assignId(db, "visits", visit.Id)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
 
+		fields := documentFields(visit)
+		intent, err := stage(p, "visits", visit.Id, auditCreate, visit.ValidFrom, nil, fields)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
 			return nil
 		}
+		defer intent.Abort()
 
-		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
+		visit.Token = intent.Token()
+		err = insert(db.C("visits"), visit)
+
+		if mgo.IsDup(err) {
+			utils.ResponseWithFailure(ctx, err, http.StatusConflict)
+			return nil
+		}
+
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		data, err := visit.MarshalJSON()
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		recordAudit(ctx, db, "visits", visit.Id, auditCreate, nil, fields)
+		notify(intent)
+
+		ctx.Response.Header.Set("Location", fmt.Sprintf("/visits/%d", visit.Id))
+		utils.ResponseWithJSON(ctx, data, http.StatusCreated)
 		return nil
 	}
 }
 
-func UpdateVisit(s *mgo.Session) func(ctx *routing.Context) error {
+func UpdateVisit(s *mgo.Session, p *events.Publisher) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		visitId, err := utils.ParseIdParameter(ctx.Param("id"))
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		c := session.DB("travels").C("visits")
-		count, err := c.Find(bson.M{"id": visitId}).Count()
-		if err != nil || count == 0 {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+		previous := bson.M{}
+		err = findOne(c, live(bson.M{"id": visitId}), &previous)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		var visit map[string]interface{}
-		err = bson.UnmarshalJSON([]byte(ctx.Request.Body()), &visit)
+		err = utils.UnmarshalObject(ctx.Request.Body(), &visit)
 
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
 		for _, v := range visit {
 			if v == nil {
-				utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+				utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 				return nil
 			}
 		}
 
-		err = c.Update(bson.M{"id": visitId}, bson.M{"$set": &visit})
+		now := time.Now().Unix()
+		intent, err := stage(p, "visits", uint32(visitId), auditUpdate, now, previous, visit)
+		if err != nil {
+			utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+			return nil
+		}
+		defer intent.Abort()
+
+		err = update(c, live(bson.M{"id": visitId}), bson.M{"$set": versioned(visit, now, intent.Token())})
 
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithFailure(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
+		recordRevision(ctx, session.DB("travels"), "visits", uint32(visitId), auditUpdate, previous)
+		recordAudit(ctx, session.DB("travels"), "visits", uint32(visitId), auditUpdate, previous, visit)
+		notify(intent)
+
 		utils.ResponseWithJSON(ctx, []byte("{}"), http.StatusOK)
 		return nil
 	}
@@ -93,7 +145,7 @@ func UpdateVisit(s *mgo.Session) func(ctx *routing.Context) error {
 
 func GetVisit(s *mgo.Session) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		session := s.Copy()
+		session := copySession(s)
 		defer session.Close()
 
 		var visit Visit
@@ -101,19 +153,19 @@ func GetVisit(s *mgo.Session) func(ctx *routing.Context) error {
 
 		visitId, err := utils.ParseIdParameter(ctx.Param("id"))
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
-		err = c.Find(bson.M{"id": visitId}).One(&visit)
+		err = findOne(c, live(bson.M{"id": visitId}), &visit)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
 		data, err := visit.MarshalJSON()
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
@@ -124,25 +176,53 @@ func GetVisit(s *mgo.Session) func(ctx *routing.Context) error {
 
 func GetUserVisit(s *mgo.Session) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
-		coreFilters, err := getCoreFiltersForUserVisits(ctx)
+		userId, err := utils.ParseIdParameter(ctx.Param("id"))
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
-		session := s.Copy()
+		query, err := userVisitsSchema.Parse(ctx.QueryArgs())
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		asOf, pointInTime, err := parseAsOf(ctx)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+			return nil
+		}
+
+		session := copySession(s)
 		defer session.Close()
 
+		if pointInTime {
+			return getUserVisitAsOf(ctx, session.DB("travels"), userId, asOf, query)
+		}
+
 		u := session.DB("travels").C("users")
-		count, err := u.Find(bson.M{"id": coreFilters["user"]}).Count()
+		count, err := countDocs(u, live(bson.M{"id": userId}))
 		if err != nil || count == 0 {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+			return nil
+		}
+
+		locationQuery, visitQuery := query.Split("location.")
+		coreFilters := live(bson.M{"user": userId})
+		visitQuery.AppendTo(coreFilters)
+		locationFilters := bson.M{"location.deleted_at": bson.M{"$exists": false}}
+		locationQuery.AppendTo(locationFilters)
+
+		paging, err := getPagingForUserVisits(ctx)
+		if err != nil {
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
-		locationFilters, err := getLocationFiltersForUserVisits(ctx)
+		projection, err := getProjectionForUserVisits(ctx)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusBadRequest)
+			utils.ResponseWithError(ctx, err, http.StatusBadRequest)
 			return nil
 		}
 
@@ -160,20 +240,15 @@ func GetUserVisit(s *mgo.Session) func(ctx *routing.Context) error {
 			},
 			bson.M{"$match": locationFilters},
 			bson.M{"$unwind": "$location"},
-			bson.M{"$sort": bson.M{"visited_at": 1}},
-			bson.M{"$project": bson.M{
-				"_id":        0,
-				"mark":       1,
-				"visited_at": 1,
-				"place":      "$location.place",
-			}},
 		}
+		pipeline = append(pipeline, paging...)
+		pipeline = append(pipeline, bson.M{"$project": projection})
 
 		visits := []bson.M{}
 
-		err = c.Pipe(pipeline).All(&visits)
+		err = pipeAll(c, pipeline, &visits)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
@@ -181,7 +256,7 @@ func GetUserVisit(s *mgo.Session) func(ctx *routing.Context) error {
 		response["visits"] = visits
 		data, err := json.Marshal(response)
 		if err != nil {
-			utils.ResponseWithJSON(ctx, []byte(""), http.StatusNotFound)
+			utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
 			return nil
 		}
 
@@ -190,54 +265,179 @@ func GetUserVisit(s *mgo.Session) func(ctx *routing.Context) error {
 	}
 }
 
-func getCoreFiltersForUserVisits(ctx *routing.Context) (map[string]interface{}, error) {
+// getUserVisitAsOf answers GetUserVisit from the versions of the user, its visits
+// and their locations valid at asOf. The filters, sorting and paging are applied
+// in memory since the versions do not live in one collection.
+func getUserVisitAsOf(ctx *routing.Context, db *mgo.Database, userId uint64, asOf int64, query filter.Filter) error {
+	stages, err := getPagingForUserVisits(ctx)
+	if err != nil {
+		utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+		return nil
+	}
+	projection, err := getProjectionForUserVisits(ctx)
+	if err != nil {
+		utils.ResponseWithError(ctx, err, http.StatusBadRequest)
+		return nil
+	}
+	stages = append(stages, bson.M{"$project": projection})
 
-	coreFilters := make(map[string]interface{}, 3)
+	byUser := filter.Filter{{Field: idField("user"), Op: filter.Eq, Value: int64(userId)}}
+	users, err := versionsAsOf(db, "users", filter.Filter{{Field: idField("id"), Op: filter.Eq, Value: int64(userId)}}, asOf)
+	if err != nil || len(users) == 0 {
+		utils.ResponseWithFailure(ctx, err, http.StatusNotFound)
+		return nil
+	}
 
-	userId, err := utils.ParseIdParameter(ctx.Param("id"))
+	visits, err := versionsAsOf(db, "visits", byUser, asOf)
 	if err != nil {
-		return nil, err
+		utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+		return nil
 	}
-	coreFilters["user"] = userId
 
-	visitedAt := make(map[string]int, 2)
+	locationIds := make([]interface{}, 0, len(visits))
+	for _, visit := range visits {
+		locationIds = append(locationIds, visit["location"])
+	}
+	locations, err := versionsAsOf(db, "locations", filter.Filter{{Field: idField("id"), Op: filter.In, Value: locationIds}}, asOf)
+	if err != nil {
+		utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+		return nil
+	}
 
-	if fromDate := ctx.QueryArgs().Peek("fromDate"); len(fromDate) > 0 {
-		date, err := strconv.Atoi(string(fromDate))
-		if err != nil {
-			return nil, err
+	matches := query.Predicate()
+	joined := make([]bson.M, 0, len(visits))
+	for _, visit := range visits {
+		location, ok := locations[asId(visit["location"])]
+		if !ok {
+			continue
 		}
-		visitedAt["$gt"] = date
-	}
 
-	if toDate := ctx.QueryArgs().Peek("toDate"); len(toDate) > 0 {
-		date, err := strconv.Atoi(string(toDate))
-		if err != nil {
-			return nil, err
+		doc := make(bson.M, len(visit))
+		for k, v := range visit {
+			doc[k] = v
+		}
+		doc["location"] = location
+
+		if matches(doc) {
+			joined = append(joined, doc)
 		}
-		visitedAt["$lt"] = date
 	}
 
-	if len(visitedAt) > 0 {
-		coreFilters["visited_at"] = visitedAt
+	sort.Slice(joined, func(i, j int) bool {
+		return documentId(joined[i]) < documentId(joined[j])
+	})
+
+	response := make(map[string][]bson.M, 1)
+	response["visits"] = applyStages(joined, stages)
+	data, err := json.Marshal(response)
+	if err != nil {
+		utils.ResponseWithFailure(ctx, err, http.StatusInternalServerError)
+		return nil
 	}
 
-	return coreFilters, nil
+	utils.ResponseWithJSON(ctx, data, http.StatusOK)
+	return nil
 }
 
-func getLocationFiltersForUserVisits(ctx *routing.Context) (map[string]interface{}, error) {
-	locationFilters := make(map[string]interface{}, 2)
-	if distance := ctx.QueryArgs().Peek("toDistance"); len(distance) > 0 {
-		dist, err := strconv.Atoi(string(distance))
-		if err != nil {
-			return nil, err
+// userVisitsSchema declares the filters of GetUserVisit, on visits joined with
+// their location. Visits are streamed under the same filters.
+var userVisitsSchema = filter.NewSchema(
+	visitedAtField,
+	filter.Field{Name: "mark", Type: filter.Int, Ops: filter.Ordered, Check: checkMark},
+	filter.Field{Name: "distance", Path: "location.distance", Type: filter.Int, Ops: filter.Ordered},
+	filter.Field{Name: "country", Path: "location.country", Type: filter.String, Ops: filter.Textual, Normalize: countryName},
+	filter.Field{Name: "city", Path: "location.city", Type: filter.String, Ops: filter.Textual, Normalize: cityName},
+	filter.Field{Name: "place", Path: "location.place", Type: filter.String, Ops: filter.Textual},
+	filter.Field{Name: "near", Path: "location.point"},
+).WithParams(dateParams...).WithParams(
+	filter.Param{Name: "minMark", Field: "mark", Op: filter.Gte},
+	filter.Param{Name: "maxMark", Field: "mark", Op: filter.Lte},
+	filter.Param{Name: "fromDistance", Field: "distance", Op: filter.Gt},
+	filter.Param{Name: "toDistance", Field: "distance", Op: filter.Lt},
+	filter.Param{Name: "country", Field: "country", Op: filter.In},
+	filter.Param{Name: "city", Field: "city", Op: filter.Eq},
+	filter.Param{Name: "place", Field: "place", Op: filter.Like},
+	nearParam,
+)
+
+var userVisitsSortFields = map[string]string{
+	"visited_at": "visited_at",
+	"mark":       "mark",
+	"place":      "location.place",
+	"distance":   "location.distance",
+}
+
+// getPagingForUserVisits turns sort (e.g. sort=-mark,visited_at), offset and limit
+// into pipeline stages. Visits are ordered by visited_at when sort is omitted.
+func getPagingForUserVisits(ctx *routing.Context) ([]bson.M, error) {
+	order := bson.D{}
+
+	if sort := ctx.QueryArgs().Peek("sort"); len(sort) > 0 {
+		for _, key := range strings.Split(string(sort), ",") {
+			direction := 1
+			if strings.HasPrefix(key, "-") {
+				direction = -1
+				key = key[1:]
+			}
+
+			field, ok := userVisitsSortFields[key]
+			if !ok {
+				return nil, fmt.Errorf("sort: unknown field %q", key)
+			}
+			for _, e := range order {
+				if e.Name == field {
+					return nil, fmt.Errorf("sort: field %q is repeated", key)
+				}
+			}
+			order = append(order, bson.DocElem{Name: field, Value: direction})
 		}
-		locationFilters["location.distance"] = bson.M{"$lt": dist}
+	} else {
+		order = append(order, bson.DocElem{Name: "visited_at", Value: 1})
 	}
 
-	if country := ctx.QueryArgs().Peek("country"); len(country) > 0 {
-		locationFilters["location.country"] = bson.M{"$eq": string(country)}
+	stages := []bson.M{bson.M{"$sort": order}}
+
+	if offset := ctx.QueryArgs().Peek("offset"); len(offset) > 0 {
+		skip, err := strconv.Atoi(string(offset))
+		if err != nil || skip < 0 {
+			return nil, fmt.Errorf("offset: %q is not a non-negative number", offset)
+		}
+		stages = append(stages, bson.M{"$skip": skip})
+	}
+
+	if limit := ctx.QueryArgs().Peek("limit"); len(limit) > 0 {
+		n, err := strconv.Atoi(string(limit))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit: %q is not a positive number", limit)
+		}
+		stages = append(stages, bson.M{"$limit": n})
+	}
+
+	return stages, nil
+}
+
+// getProjectionForUserVisits adds the location id and city to every visit when
+// requested with include=location,city.
+func getProjectionForUserVisits(ctx *routing.Context) (bson.M, error) {
+	projection := bson.M{
+		"_id":        0,
+		"mark":       1,
+		"visited_at": 1,
+		"place":      "$location.place",
+	}
+
+	if include := ctx.QueryArgs().Peek("include"); len(include) > 0 {
+		for _, field := range strings.Split(string(include), ",") {
+			switch field {
+			case "location":
+				projection["location"] = "$location.id"
+			case "city":
+				projection["city"] = "$location.city"
+			default:
+				return nil, fmt.Errorf("include: unknown field %q", field)
+			}
+		}
 	}
 
-	return locationFilters, nil
+	return projection, nil
 }
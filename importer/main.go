@@ -6,42 +6,92 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/agneum/travels/logging"
+	"github.com/agneum/travels/metrics"
+	"github.com/agneum/travels/reference"
+	"github.com/agneum/travels/search"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const zipPath = "/tmp/data"
 const dataPath = "/tmp/extract"
 
-func Import() {
+// Import ensures the indexes, loads the dataset into Mongo and seeds the id
+// counters, recording its progress in the State. It is meant to run while the
+// server already listens, writes being refused until it has finished: a failure
+// is recorded rather than fatal, and leaves the service not ready. Documents
+// already imported by an earlier run are skipped.
+func Import() error {
+	err := runImport()
+	if err != nil {
+		updateState(func(s *State) {
+			s.Error = err.Error()
+		})
+		return err
+	}
+
+	updateState(func(s *State) {
+		s.FinishedAt = time.Now()
+	})
+	metrics.ImportDone()
+	return nil
+}
+
+func runImport() error {
 	session, err := mgo.Dial("localhost:27017")
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("unable to connect: %v", err)
 	}
 	defer session.Close()
 
 	session.SetMode(mgo.Monotonic, true)
 	session.SetSocketTimeout(10 * time.Minute)
 
+	err = ensureIndexes(session)
+	if err != nil {
+		return fmt.Errorf("unable to ensure indexes: %v", err)
+	}
+
+	updateState(func(s *State) {
+		s.IndexesEnsured = true
+	})
+
 	err = unzip(fmt.Sprintf("%s/%s", zipPath, "data.zip"), dataPath)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("unable to unzip data: %v", err)
 	}
 
-	err = importData(session)
+	dataset, err := datasetTime()
 	if err != nil {
-		log.Fatal(err)
+		logging.Log(logging.Warn, "unable to read dataset timestamp", logging.Fields{"error": err})
 	}
 
-	err = ensureIndexes(session)
+	failed, err := importData(session)
+	if err != nil {
+		return fmt.Errorf("unable to import data: %v", err)
+	}
+
+	updateState(func(s *State) {
+		s.Imported = len(failed) == 0
+		s.FailedFiles = failed
+		s.DatasetTime = dataset
+	})
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to import %s", strings.Join(failed, ", "))
+	}
+
+	err = seedCounters(session)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("unable to seed counters: %v", err)
 	}
+
+	return nil
 }
 
 func unzip(archive, target string) error {
@@ -81,27 +131,33 @@ func unzip(archive, target string) error {
 	return nil
 }
 
-func importData(s *mgo.Session) error {
+// importData inserts every data file and returns the names of those that could
+// not be imported.
+func importData(s *mgo.Session) ([]string, error) {
 	session := s.Copy()
 	defer session.Close()
 
 	files, err := ioutil.ReadDir(dataPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var failed []string
+
 	for _, f := range files {
 		if filepath.Ext(f.Name()) != ".json" {
 			continue
 		}
 		err := importFile(session, f.Name())
 		if err != nil {
-			log.Printf("%+v\n", err.Error())
+			logging.Log(logging.Error, "unable to import file", logging.Fields{"file": f.Name(), "error": err})
+			failed = append(failed, f.Name())
+			continue
 		}
-		fmt.Println(f.Name())
+		logging.Log(logging.Info, "file imported", logging.Fields{"file": f.Name()})
 	}
 
-	return nil
+	return failed, nil
 }
 
 func importFile(s *mgo.Session, filename string) error {
@@ -119,12 +175,68 @@ func importFile(s *mgo.Session, filename string) error {
 		return err
 	}
 
-	dataCollection := s.DB("travels").C(collection)
-	err = dataCollection.Insert(importData[collection]...)
+	for _, doc := range importData[collection] {
+		switch collection {
+		case "users":
+			widenBirthDate(doc)
+		case "locations":
+			normalizeLocation(doc)
+		}
+		if fields, ok := doc.(map[string]interface{}); ok && collection != "visits" {
+			fields[search.Field] = search.Words(collection, fields)
+		}
+	}
+
+	// The unique id indexes are already in place, so documents imported by an
+	// earlier run are refused one by one without stopping the others.
+	bulk := s.DB("travels").C(collection).Bulk()
+	bulk.Unordered()
+	bulk.Insert(importData[collection]...)
+	_, err = bulk.Run()
+	if bulkErr, ok := err.(*mgo.BulkError); ok && mgo.IsDup(bulkErr) {
+		logging.Log(logging.Info, "skipped documents imported before", logging.Fields{
+			"file":      filename,
+			"documents": len(bulkErr.Cases()),
+		})
+		err = nil
+	}
+	metrics.FileImported(collection, len(importData[collection]), err)
 
 	return err
 }
 
+// widenBirthDate stores the birth date of an imported user as a 64-bit integer
+// rather than the float it is decoded as, like the handlers do.
+func widenBirthDate(doc interface{}) {
+	user, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if birthDate, ok := user["birth_date"].(float64); ok {
+		user["birth_date"] = int64(birthDate)
+	}
+}
+
+// normalizeLocation stores an imported location under the canonical country and
+// city names, as the handlers do on write.
+func normalizeLocation(doc interface{}) {
+	location, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if country, ok := location["country"].(string); ok {
+		name, code := reference.NormalizeCountry(country)
+		location["country"] = name
+		if code != "" {
+			location["country_code"] = code
+		}
+	}
+	if city, ok := location["city"].(string); ok {
+		country, _ := location["country"].(string)
+		location["city"] = reference.NormalizeCity(country, city)
+	}
+}
+
 func ensureIndexes(s *mgo.Session) error {
 	c := s.DB("travels").C("users")
 	err := c.EnsureIndex(mgo.Index{
@@ -142,6 +254,30 @@ func ensureIndexes(s *mgo.Session) error {
 		return err
 	}
 
+	err = c.EnsureIndex(mgo.Index{
+		Key:             []string{"$text:first_name", "$text:last_name", "$text:email"},
+		Weights:         search.Fields["users"],
+		DefaultLanguage: "none",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{search.Field + ".w"},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key:    []string{"deleted_at"},
+		Sparse: true,
+	})
+	if err != nil {
+		return err
+	}
+
 	c = s.DB("travels").C("locations")
 	err = c.EnsureIndex(mgo.Index{
 		Key:    []string{"id"},
@@ -151,6 +287,44 @@ func ensureIndexes(s *mgo.Session) error {
 		return err
 	}
 
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{"$2dsphere:point"},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{"country"},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key:    []string{"deleted_at"},
+		Sparse: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key:             []string{"$text:place", "$text:city", "$text:country"},
+		Weights:         search.Fields["locations"],
+		DefaultLanguage: "none",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{search.Field + ".w"},
+	})
+	if err != nil {
+		return err
+	}
+
 	c = s.DB("travels").C("visits")
 	err = c.EnsureIndex(mgo.Index{
 		Key:    []string{"id"},
@@ -174,5 +348,77 @@ func ensureIndexes(s *mgo.Session) error {
 		return err
 	}
 
+	c = s.DB("travels").C("similarities")
+	err = c.EnsureIndex(mgo.Index{
+		Key:    []string{"location"},
+		Unique: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	c = s.DB("travels").C("audit")
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{"entity", "entity_id", "-at"},
+	})
+	if err != nil {
+		return err
+	}
+
+	c = s.DB("travels").C("revisions")
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{"entity", "entity_id", "-_id"},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{"entity", "replaced_at"},
+	})
+	if err != nil {
+		return err
+	}
+
+	c = s.DB("travels").C("outbox")
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{"sink", "failed", "next_attempt"},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.EnsureIndex(mgo.Index{
+		Key: []string{"event.id"},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func seedCounters(s *mgo.Session) error {
+	db := s.DB("travels")
+
+	for _, collection := range []string{"users", "locations", "visits"} {
+		var last struct {
+			Id uint32 `bson:"id"`
+		}
+
+		err := db.C(collection).Find(nil).Sort("-id").Select(bson.M{"id": 1}).One(&last)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = db.C("counters").UpsertId(collection, bson.M{"$max": bson.M{"seq": last.Id}})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,64 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State describes how far the import got, for readiness and status reporting.
+type State struct {
+	Imported       bool      `json:"imported"`
+	IndexesEnsured bool      `json:"indexes_ensured"`
+	FinishedAt     time.Time `json:"finished_at"`
+	DatasetTime    int64     `json:"dataset_time"`
+	FailedFiles    []string  `json:"failed_files,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Ready tells whether the import finished without errors.
+func (s State) Ready() bool {
+	return s.Error == "" && !s.FinishedAt.IsZero()
+}
+
+var (
+	stateMu sync.RWMutex
+	state   State
+)
+
+func Status() State {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state
+}
+
+func updateState(update func(s *State)) {
+	stateMu.Lock()
+	update(&state)
+	stateMu.Unlock()
+}
+
+// datasetTime reads the generation timestamp from the first line of options.txt
+// shipped next to the archive, falling back to the archive modification time.
+func datasetTime() (int64, error) {
+	file, err := os.Open(fmt.Sprintf("%s/%s", zipPath, "options.txt"))
+	if err == nil {
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		if scanner.Scan() {
+			return strconv.ParseInt(strings.TrimSpace(scanner.Text()), 10, 64)
+		}
+	}
+
+	info, err := os.Stat(fmt.Sprintf("%s/%s", zipPath, "data.zip"))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.ModTime().Unix(), nil
+}
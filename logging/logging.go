@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, n := range levelNames {
+		if n == strings.ToLower(name) {
+			return level, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", name)
+}
+
+type Fields map[string]interface{}
+
+var (
+	mu       sync.Mutex
+	out      io.Writer = os.Stdout
+	minLevel           = Info
+)
+
+func SetLevel(level Level) {
+	mu.Lock()
+	minLevel = level
+	mu.Unlock()
+}
+
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	out = w
+	mu.Unlock()
+}
+
+func Enabled(level Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return level >= minLevel
+}
+
+// Log writes one JSON object per line with time, level and msg next to fields.
+func Log(level Level, msg string, fields Fields) {
+	if !Enabled(level) {
+		return
+	}
+
+	entry := make(Fields, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(Fields{"level": Error.String(), "msg": "unable to encode log entry", "error": err.Error()})
+	}
+
+	mu.Lock()
+	out.Write(append(line, '\n'))
+	mu.Unlock()
+}
+
+// Fatal logs at error level and exits.
+func Fatal(msg string, fields Fields) {
+	Log(Error, msg, fields)
+	os.Exit(1)
+}
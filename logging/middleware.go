@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agneum/travels/utils"
+	"github.com/mailru/easyjson/jlexer"
+	"github.com/valyala/fasthttp"
+	mgo "gopkg.in/mgo.v2"
+)
+
+var (
+	requestSeq   uint64
+	requestEpoch = time.Now().UnixNano()
+
+	samplingMu sync.Mutex
+	sampling   = make(map[string]uint64)
+	sampled    = make(map[string]*uint64)
+)
+
+// init applies TRAVELS_LOG_LEVEL (debug, info, warn, error) and TRAVELS_LOG_SAMPLE,
+// a comma separated list of route=N pairs keeping one successful access log line
+// in N for that route, e.g. "/users/<id>=100,/locations/<id>/avg=10".
+func init() {
+	if name := os.Getenv("TRAVELS_LOG_LEVEL"); name != "" {
+		level, err := ParseLevel(name)
+		if err != nil {
+			Log(Warn, "ignoring TRAVELS_LOG_LEVEL", Fields{"error": err})
+		}
+		SetLevel(level)
+	}
+
+	if rules := os.Getenv("TRAVELS_LOG_SAMPLE"); rules != "" {
+		for _, rule := range strings.Split(rules, ",") {
+			parts := strings.SplitN(rule, "=", 2)
+			every, err := strconv.ParseUint(strings.TrimSpace(parts[len(parts)-1]), 10, 64)
+			if len(parts) != 2 || err != nil || every == 0 {
+				Log(Warn, "ignoring TRAVELS_LOG_SAMPLE rule", Fields{"rule": rule})
+				continue
+			}
+			SetSampling(strings.TrimSpace(parts[0]), every)
+		}
+	}
+}
+
+// SetSampling keeps one access log line in every for successful requests on route.
+func SetSampling(route string, every uint64) {
+	samplingMu.Lock()
+	sampling[route] = every
+	sampled[route] = new(uint64)
+	samplingMu.Unlock()
+}
+
+func keep(route string) bool {
+	samplingMu.Lock()
+	every, ok := sampling[route]
+	seen := sampled[route]
+	samplingMu.Unlock()
+
+	if !ok {
+		return true
+	}
+	return atomic.AddUint64(seen, 1)%every == 1 || every == 1
+}
+
+// Middleware tags every request with an id, taken from X-Request-Id when the
+// client sent one, and writes an access log line once it has been served.
+func Middleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+
+		id := string(ctx.Request.Header.Peek("X-Request-Id"))
+		if id == "" {
+			id = fmt.Sprintf("%x-%x", requestEpoch, atomic.AddUint64(&requestSeq, 1))
+		}
+		utils.SetRequestId(ctx, id)
+		ctx.Response.Header.Set("X-Request-Id", id)
+
+		next(ctx)
+
+		status := ctx.Response.StatusCode()
+		route := utils.RouteLabel(ctx)
+		level := Info
+		switch {
+		case status >= 500:
+			level = Error
+		case status >= 400:
+			level = Warn
+		}
+
+		if level == Info && !keep(route) {
+			return
+		}
+
+		fields := Fields{
+			"request_id": id,
+			"method":     string(ctx.Method()),
+			"route":      route,
+			"path":       string(ctx.Path()),
+			"status":     status,
+			"latency_ms": float64(time.Since(start).Nanoseconds()) / 1e6,
+			"remote_ip":  ctx.RemoteIP().String(),
+		}
+		if err := utils.RequestError(ctx); err != nil {
+			fields["error"] = err
+			fields["error_kind"] = ErrorKind(err, status)
+		}
+
+		Log(level, "request", fields)
+	}
+}
+
+// ErrorKind tells apart the failures worth alerting on differently: missing
+// documents, undecodable bodies, duplicates, timeouts and unreachable Mongo.
+func ErrorKind(err error, status int) string {
+	if err == mgo.ErrNotFound {
+		return "not_found"
+	}
+	if mgo.IsDup(err) {
+		return "duplicate"
+	}
+
+	switch e := err.(type) {
+	case *jlexer.LexerError, *json.SyntaxError, *json.UnmarshalTypeError:
+		return "decode"
+	case net.Error:
+		if e.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+
+	if strings.Contains(err.Error(), "no reachable servers") {
+		return "unavailable"
+	}
+	if strings.Contains(err.Error(), "timeout") {
+		return "timeout"
+	}
+	if status < 500 {
+		return "invalid_request"
+	}
+
+	return "internal"
+}
@@ -1,39 +1,258 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	mgo "gopkg.in/mgo.v2"
 
+	"github.com/agneum/travels/age"
+	"github.com/agneum/travels/auth"
+	"github.com/agneum/travels/events"
 	"github.com/agneum/travels/handlers"
 	"github.com/agneum/travels/importer"
+	"github.com/agneum/travels/logging"
+	"github.com/agneum/travels/metrics"
+	"github.com/agneum/travels/ratelimit"
+	"github.com/agneum/travels/recommend"
+	"github.com/agneum/travels/utils"
 	"github.com/qiangxue/fasthttp-routing"
 	"github.com/valyala/fasthttp"
 )
 
-func init() {
-	importer.Import()
-}
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var (
+	addr            = flag.String("addr", ":80", "address to listen on")
+	readTimeout     = flag.Duration("read-timeout", 5*time.Second, "maximum duration for reading a request")
+	writeTimeout    = flag.Duration("write-timeout", 10*time.Second, "maximum duration for writing a response")
+	idleTimeout     = flag.Duration("idle-timeout", time.Minute, "maximum keep-alive idle duration")
+	maxConnsPerIP   = flag.Int("max-conns-per-ip", 0, "maximum concurrent connections per client IP, 0 is unlimited")
+	concurrency     = flag.Int("concurrency", fasthttp.DefaultConcurrency, "maximum concurrent connections")
+	maxBodySize     = flag.Int("max-body-size", 1<<20, "maximum request body size in bytes, applies to /batch")
+	maxEntitySize   = flag.Int("max-entity-size", 16<<10, "maximum body size in bytes for entity creates and updates")
+	rateLimits      = flag.String("rate-limits", "", "per client limits as route=rate:burst pairs, * for any route, e.g. /locations/<id>/avg=20:40")
+	maxInFlight     = flag.Int64("max-in-flight", 0, "maximum requests served at once before answering 503, 0 is unlimited")
+	webhookURLs     = flag.String("webhook-urls", "", "comma separated URLs receiving entity change events, signed with TRAVELS_WEBHOOK_SECRET")
+	eventsFile      = flag.String("events-file", "", "file receiving entity change events as NDJSON")
+	ageTimezone     = flag.String("age-timezone", "UTC", "IANA time zone birthdays start in when filtering by age")
+	recommendEvery  = flag.Duration("recommendations-interval", time.Hour, "how often location similarities for recommendations are recomputed, 0 disables it")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 15*time.Second, "time allowed to drain in-flight requests")
+	issueToken      = flag.String("issue-token", "", "print a bearer token for name:role signed with TRAVELS_TOKEN_SECRET and exit")
+	tokenTTL        = flag.Duration("token-ttl", 24*time.Hour, "how long tokens printed by -issue-token are valid")
+	anonymousWrites = flag.Bool("allow-anonymous-writes", false, "let writes through without credentials while TRAVELS_API_KEYS and TRAVELS_TOKEN_SECRET are unset; they are refused with 401 otherwise")
+)
 
 func main() {
+	flag.Parse()
+
+	rules, err := ratelimit.ParseRules(*rateLimits)
+	if err != nil {
+		logging.Fatal("invalid -rate-limits", logging.Fields{"error": err})
+	}
+
+	timezone, err := time.LoadLocation(*ageTimezone)
+	if err != nil {
+		logging.Fatal("invalid -age-timezone", logging.Fields{"error": err})
+	}
+	age.SetLocation(timezone)
+
+	authenticator, err := auth.FromEnv()
+	if err != nil {
+		logging.Fatal("invalid authentication settings", logging.Fields{"error": err})
+	}
+	if *issueToken != "" {
+		token, err := issue(authenticator, *issueToken, *tokenTTL)
+		if err != nil {
+			logging.Fatal("unable to issue token", logging.Fields{"error": err})
+		}
+		fmt.Println(token)
+		return
+	}
+	if !authenticator.Enabled() {
+		if *anonymousWrites {
+			authenticator.AllowAnonymous()
+			logging.Log(logging.Warn, "no API keys or token secret configured, write routes are open and admin routes closed", nil)
+		} else {
+			logging.Log(logging.Warn, "no API keys or token secret configured, write and admin routes answer 401", nil)
+		}
+	}
+
 	session, err := mgo.Dial("localhost:27017")
 	if err != nil {
 		panic(err)
 	}
-	defer session.Close()
 
 	session.SetMode(mgo.Monotonic, true)
 
+	var sinks []events.Sink
+	if *webhookURLs != "" {
+		secret := []byte(os.Getenv("TRAVELS_WEBHOOK_SECRET"))
+		for _, url := range strings.Split(*webhookURLs, ",") {
+			sinks = append(sinks, events.NewWebhook(strings.TrimSpace(url), secret))
+		}
+	}
+	if *eventsFile != "" {
+		file, err := events.NewFile(*eventsFile)
+		if err != nil {
+			logging.Fatal("unable to open events file", logging.Fields{"error": err})
+		}
+		defer file.Close()
+		sinks = append(sinks, file)
+	}
+	publisher := events.NewPublisher(session, sinks...)
+	hub := events.NewHub()
+	publisher.AddLocal(hub)
+	visits := handlers.JoinVisits(session, hub)
+
 	router := routing.New()
+	router.NotFound(routing.MethodNotAllowedHandler, utils.Unmatched, routing.NotFoundHandler)
+	router.Get(`/metrics`, metrics.Handler())
+	router.Get(`/healthz`, handlers.Healthz())
+	router.Get(`/readyz`, handlers.Readyz(session))
+	router.Get(`/status`, handlers.Status(session, version))
+	router.Get(`/search`, handlers.Search(session))
 	router.Get(`/users/<id:\d+>`, handlers.GetUser(session))
 	router.Get(`/users/<id:\d+>/visits`, handlers.GetUserVisit(session))
+	router.Get(`/users/<id:\d+>/summary`, handlers.GetUserSummary(session))
+	router.Get(`/users/<id:\d+>/recommendations`, handlers.GetRecommendations(session))
+	router.Get(`/users/<id:\d+>/visits/stream`, handlers.StreamUserVisits(session, visits))
+	router.Get(`/locations/near`, handlers.GetNearLocations(session))
+	router.Get(`/locations/top`, handlers.GetTopLocations(session))
 	router.Get(`/locations/<id:\d+>`, handlers.GetLocation(session))
 	router.Get(`/locations/<id:\d+>/avg`, handlers.GetAverageMark(session))
+	router.Get(`/locations/<id:\d+>/timeseries`, handlers.GetLocationTimeseries(session))
+	router.Get(`/locations/<id:\d+>/visits/stream`, handlers.StreamLocationVisits(session, visits))
 	router.Get(`/visits/<id:\d+>`, handlers.GetVisit(session))
-	router.Post(`/users/new`, handlers.CreateUser(session))
-	router.Post(`/users/<id:\d+>`, handlers.UpdateUser(session))
-	router.Post(`/locations/new`, handlers.CreateLocation(session))
-	router.Post(`/locations/<id:\d+>`, handlers.UpdateLocation(session))
-	router.Post(`/visits/new`, handlers.CreateVisit(session))
-	router.Post(`/visits/<id:\d+>`, handlers.UpdateVisit(session))
-
-	panic(fasthttp.ListenAndServe(":80", router.HandleRequest))
+
+	writer := authenticator.Require(auth.Writer)
+	imported := handlers.RequireImported
+	entityBody := utils.JSONBody(*maxEntitySize)
+	router.Post(`/users/new`, writer, imported, entityBody, handlers.CreateUser(session, publisher))
+	router.Post(`/users/<id:\d+>`, writer, imported, entityBody, handlers.UpdateUser(session, publisher))
+	router.Post(`/locations/new`, writer, imported, entityBody, handlers.CreateLocation(session, publisher))
+	router.Post(`/locations/<id:\d+>`, writer, imported, entityBody, handlers.UpdateLocation(session, publisher))
+	router.Post(`/visits/new`, writer, imported, entityBody, handlers.CreateVisit(session, publisher))
+	router.Post(`/visits/<id:\d+>`, writer, imported, entityBody, handlers.UpdateVisit(session, publisher))
+	router.Post(`/batch`, writer, imported, utils.JSONBody(*maxBodySize), handlers.Batch(session, publisher))
+	router.Get(`/audit`, authenticator.Require(auth.Admin), handlers.GetAudit(session))
+
+	for _, entity := range []string{"users", "locations", "visits"} {
+		router.Delete(`/`+entity+`/<id:\d+>`, writer, imported, handlers.DeleteEntity(session, publisher, entity))
+		router.Post(`/`+entity+`/<id:\d+>/restore`, writer, imported, handlers.RestoreEntity(session, publisher, entity))
+		router.Get(`/`+entity+`/<id:\d+>/history`, authenticator.Require(auth.Admin), handlers.GetHistory(session, entity))
+	}
+
+	handler := ratelimit.New(rules, authenticator.Client).Middleware(router.HandleRequest)
+	handler = ratelimit.InFlight(*maxInFlight, handler)
+	handler = metrics.Middleware(handler)
+	handler = logging.Middleware(handler)
+
+	server := &fasthttp.Server{
+		Handler:            handler,
+		Name:               "travels",
+		ReadTimeout:        *readTimeout,
+		WriteTimeout:       *writeTimeout,
+		IdleTimeout:        *idleTimeout,
+		MaxConnsPerIP:      *maxConnsPerIP,
+		Concurrency:        *concurrency,
+		MaxRequestBodySize: *maxBodySize,
+	}
+
+	// Recommendations are computed from the visits, so only once they are in.
+	importDone := make(chan struct{})
+	stopJobs := make(chan struct{})
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		if *recommendEvery <= 0 {
+			return
+		}
+
+		select {
+		case <-importDone:
+			recommend.Run(session, *recommendEvery, stopJobs)
+		case <-stopJobs:
+		}
+	}()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe(*addr)
+	}()
+
+	go func() {
+		err := importer.Import()
+		if err != nil {
+			logging.Log(logging.Error, "import failed, the service stays not ready", logging.Fields{"error": err})
+			return
+		}
+		close(importDone)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serveErr:
+		session.Close()
+		logging.Fatal("server stopped", logging.Fields{"error": err})
+	case sig := <-signals:
+		logging.Log(logging.Info, "shutting down", logging.Fields{"signal": sig.String()})
+	}
+
+	close(stopJobs)
+	shutdown(server, session, publisher, hub, jobsDone)
+}
+
+// issue signs a bearer token for a name:role pair.
+func issue(a *auth.Authenticator, spec string, ttl time.Duration) (string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", fmt.Errorf("-issue-token %q: expected name:role", spec)
+	}
+
+	role, err := auth.ParseRole(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	return a.Sign(parts[0], role, ttl)
+}
+
+// shutdown ends the open event streams, stops accepting connections, waits for
+// in-flight requests, delivers the pending events and waits for the background
+// jobs, all within shutdownTimeout, and closes the Mongo session once nothing
+// uses it anymore.
+func shutdown(server *fasthttp.Server, session *mgo.Session, publisher *events.Publisher, hub *events.Hub, jobs <-chan struct{}) {
+	hub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	err := server.ShutdownWithContext(ctx)
+	if err != nil {
+		logging.Log(logging.Warn, "in-flight requests were not drained in time", logging.Fields{"error": err})
+	}
+
+	err = publisher.Close(ctx)
+	if err != nil {
+		logging.Log(logging.Warn, "pending events were not delivered in time", logging.Fields{"error": err})
+	}
+
+	select {
+	case <-jobs:
+	case <-ctx.Done():
+		logging.Log(logging.Warn, "background jobs did not finish in time", logging.Fields{"error": ctx.Err()})
+	}
+
+	session.Close()
+	logging.Log(logging.Info, "shutdown complete", nil)
 }
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/agneum/travels/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "travels_http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "travels_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"method", "route"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "travels_mongo_query_duration_seconds",
+		Help:    "Mongo call latency by collection.",
+		Buckets: []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .5},
+	}, []string{"collection"})
+
+	sessionCopies = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "travels_mongo_session_copies_total",
+		Help: "Mongo sessions copied for request handling.",
+	})
+
+	importedFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "travels_import_files_total",
+		Help: "Data files processed by the importer by collection and result.",
+	}, []string{"collection", "result"})
+
+	importedDocuments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "travels_import_documents_total",
+		Help: "Documents inserted by the importer by collection.",
+	}, []string{"collection"})
+
+	importDone = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "travels_import_done",
+		Help: "1 once the importer has loaded the data and ensured indexes.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration, queryDuration, sessionCopies,
+		importedFiles, importedDocuments, importDone)
+}
+
+// Middleware records the count, latency and status code of every request.
+func Middleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		next(ctx)
+
+		method := string(ctx.Method())
+		route := utils.RouteLabel(ctx)
+		code := strconv.Itoa(ctx.Response.StatusCode())
+
+		requests.WithLabelValues(method, route, code).Inc()
+		requestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler exposes the registered metrics in the Prometheus text format.
+func Handler() func(ctx *routing.Context) error {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+
+	return func(ctx *routing.Context) error {
+		handler(ctx.RequestCtx)
+		return nil
+	}
+}
+
+// Query starts timing a Mongo call on collection, the returned func stops it.
+func Query(collection string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.WithLabelValues(collection).Observe(time.Since(start).Seconds())
+	}
+}
+
+func SessionCopied() {
+	sessionCopies.Inc()
+}
+
+func FileImported(collection string, documents int, err error) {
+	if err != nil {
+		importedFiles.WithLabelValues(collection, "error").Inc()
+		return
+	}
+
+	importedFiles.WithLabelValues(collection, "ok").Inc()
+	importedDocuments.WithLabelValues(collection).Add(float64(documents))
+}
+
+func ImportDone() {
+	importDone.Set(1)
+}
@@ -0,0 +1,180 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agneum/travels/utils"
+	"github.com/valyala/fasthttp"
+)
+
+// AnyRoute is the rule key applied to routes without a rule of their own.
+const AnyRoute = "*"
+
+const sweepInterval = time.Minute
+
+// Rule allows Rate requests per second on average with bursts of up to Burst.
+type Rule struct {
+	Rate  float64
+	Burst float64
+}
+
+// ParseRules reads a comma separated list of route=rate:burst pairs, routes being
+// named like utils.RouteLabel does, e.g. "/locations/<id>/avg=20:40,*=200:400".
+func ParseRules(spec string) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+	if strings.TrimSpace(spec) == "" {
+		return rules, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("rate limit %q: expected route=rate:burst", pair)
+		}
+
+		values := strings.SplitN(parts[1], ":", 2)
+		rate, err := strconv.ParseFloat(values[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("rate limit %q: invalid rate", pair)
+		}
+
+		burst := rate
+		if len(values) == 2 {
+			burst, err = strconv.ParseFloat(values[1], 64)
+			if err != nil || burst < 1 {
+				return nil, fmt.Errorf("rate limit %q: invalid burst", pair)
+			}
+		}
+
+		rules[parts[0]] = Rule{Rate: rate, Burst: burst}
+	}
+
+	return rules, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rule   Rule
+}
+
+// Limiter keeps one token bucket per route and client.
+type Limiter struct {
+	mu        sync.Mutex
+	rules     map[string]Rule
+	client    func(ctx *fasthttp.RequestCtx) string
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New returns a limiter applying rules to the clients that client tells apart.
+// client must only trust verified credentials, otherwise a caller could get a new
+// bucket with every request.
+func New(rules map[string]Rule, client func(ctx *fasthttp.RequestCtx) string) *Limiter {
+	return &Limiter{
+		rules:     rules,
+		client:    client,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token for client on route. When none is left it returns how long
+// the client should wait before retrying.
+func (l *Limiter) Allow(route, client string, now time.Time) (bool, time.Duration) {
+	rule, ok := l.rules[route]
+	if !ok {
+		rule, ok = l.rules[AnyRoute]
+	}
+	if !ok {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	key := route + " " + client
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rule.Burst, last: now, rule: rule}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rule.Burst, b.tokens+now.Sub(b.last).Seconds()*rule.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled completely, they carry no state.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rule.Rate >= b.rule.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware answers 429 with Retry-After once a client runs out of tokens on a
+// route.
+func (l *Limiter) Middleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ok, wait := l.Allow(utils.RouteLabel(ctx), l.client(ctx), time.Now())
+		if !ok {
+			reject(ctx, fasthttp.StatusTooManyRequests, wait, "rate limit exceeded")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// InFlight answers 503 with Retry-After while max requests are already being
+// served. A max of 0 disables the limit.
+func InFlight(max int64, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if max <= 0 {
+		return next
+	}
+
+	var inFlight int64
+	return func(ctx *fasthttp.RequestCtx) {
+		if atomic.AddInt64(&inFlight, 1) > max {
+			atomic.AddInt64(&inFlight, -1)
+			reject(ctx, fasthttp.StatusServiceUnavailable, time.Second, "server is saturated")
+			return
+		}
+		defer atomic.AddInt64(&inFlight, -1)
+
+		next(ctx)
+	}
+}
+
+func reject(ctx *fasthttp.RequestCtx, code int, wait time.Duration, reason string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(seconds))
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(code)
+	ctx.SetBodyString(`{"error":"` + reason + `"}`)
+}
@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(" /locations/<id>/avg=20:40, *=2.5 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]Rule{
+		"/locations/<id>/avg": {Rate: 20, Burst: 40},
+		AnyRoute:              {Rate: 2.5, Burst: 2.5},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %v, want %v", rules, want)
+	}
+	for route, rule := range want {
+		if rules[route] != rule {
+			t.Errorf("%s: got %+v, want %+v", route, rules[route], rule)
+		}
+	}
+
+	if rules, err := ParseRules("  "); err != nil || len(rules) != 0 {
+		t.Errorf("empty spec: got %v, %v", rules, err)
+	}
+
+	for _, spec := range []string{"/users", "/users=x", "/users=0", "/users=-1:2", "/users=1:0", "/users=1:x"} {
+		if _, err := ParseRules(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	l := New(map[string]Rule{
+		"/users/<id>": {Rate: 2, Burst: 3},
+		AnyRoute:      {Rate: 1, Burst: 1},
+	}, nil)
+	now := time.Unix(1500000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("/users/<id>", "a", now); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+
+	ok, wait := l.Allow("/users/<id>", "a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("request over the burst: got %v, wait %v", ok, wait)
+	}
+
+	if ok, _ := l.Allow("/users/<id>", "b", now); !ok {
+		t.Error("another client shares the bucket")
+	}
+
+	if ok, _ := l.Allow("/users/<id>", "a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("the bucket did not refill at the rate")
+	}
+
+	if ok, _ := l.Allow("/visits/<id>", "a", now); !ok {
+		t.Error("the first request on another route was refused")
+	}
+	if ok, _ := l.Allow("/visits/<id>", "a", now); ok {
+		t.Error("the * rule was not applied")
+	}
+	if ok, _ := l.Allow("/locations/<id>", "a", now); !ok {
+		t.Error("routes share their buckets")
+	}
+
+	unlimited := New(map[string]Rule{"/users/<id>": {Rate: 1, Burst: 1}}, nil)
+	for i := 0; i < 10; i++ {
+		if ok, _ := unlimited.Allow("/visits/<id>", "a", now); !ok {
+			t.Fatal("a route without a rule was limited")
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	l := New(map[string]Rule{AnyRoute: {Rate: 1, Burst: 100}}, nil)
+	l.lastSweep = start
+
+	l.Allow("/users", "idle", start)
+	for i := 0; i < 100; i++ {
+		l.Allow("/users", "busy", start)
+	}
+
+	l.sweep(start.Add(sweepInterval / 2))
+	if len(l.buckets) != 2 {
+		t.Fatalf("swept before the interval: %d buckets left", len(l.buckets))
+	}
+
+	l.sweep(start.Add(sweepInterval))
+	if _, ok := l.buckets["/users idle"]; ok {
+		t.Error("a refilled bucket was kept")
+	}
+	if _, ok := l.buckets["/users busy"]; !ok {
+		t.Error("a drained bucket was dropped")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	client := func(ctx *fasthttp.RequestCtx) string {
+		return ctx.RemoteIP().String()
+	}
+	handler := New(map[string]Rule{AnyRoute: {Rate: 1, Burst: 1}}, client).Middleware(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	})
+
+	request := func(key string) int {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, nil)
+		ctx.Request.SetRequestURI("/users/1")
+		ctx.Request.Header.Set("X-Api-Key", key)
+		handler(ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	if code := request("one"); code != fasthttp.StatusOK {
+		t.Fatalf("first request: got %d", code)
+	}
+	if code := request("two"); code != fasthttp.StatusTooManyRequests {
+		t.Errorf("a new unverified key got a new bucket: got %d", code)
+	}
+}
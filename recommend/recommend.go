@@ -0,0 +1,213 @@
+package recommend
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/agneum/travels/logging"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Collection holds, for every location, the locations most often liked by the
+// same users.
+const Collection = "similarities"
+
+const (
+	// MinMark is the lowest mark counted as liking a location.
+	MinMark = 4
+
+	neighbours      = 50
+	maxLikesPerUser = 200
+)
+
+// Neighbour is a location similar to another one, Score being the cosine of their
+// sets of users in [0, 1].
+type Neighbour struct {
+	Location uint32  `bson:"location"`
+	Score    float64 `bson:"score"`
+}
+
+type Similarity struct {
+	Location   uint32      `bson:"location"`
+	Neighbours []Neighbour `bson:"neighbours"`
+	ComputedAt int64       `bson:"computed_at"`
+}
+
+type like struct {
+	User      uint32 `bson:"user"`
+	Location  uint32 `bson:"location"`
+	VisitedAt int64  `bson:"visited_at"`
+}
+
+// Precompute rebuilds the similarities from the visits marked MinMark or more.
+// Two locations are the more similar the more users liked both of them. Only the
+// maxLikesPerUser latest likes of every user count; they are kept while reading
+// rather than sorted by Mongo, which would sort the whole collection in memory.
+// A run that finds no similarities keeps those of the previous one.
+func Precompute(s *mgo.Session) error {
+	started := time.Now()
+
+	session := s.Copy()
+	defer session.Close()
+	session.SetSocketTimeout(10 * time.Minute)
+
+	db := session.DB("travels")
+
+	byUser := make(map[uint32][]like)
+
+	iter := db.C("visits").Find(bson.M{
+		"mark":       bson.M{"$gte": MinMark},
+		"deleted_at": bson.M{"$exists": false},
+	}).Select(bson.M{"user": 1, "location": 1, "visited_at": 1}).Iter()
+
+	var l like
+	for iter.Next(&l) {
+		likes := append(byUser[l.User], l)
+		if len(likes) >= 2*maxLikesPerUser {
+			likes = latest(likes, maxLikesPerUser)
+		}
+		byUser[l.User] = likes
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	liked := make(map[uint32][]uint32, len(byUser))
+	for user, likes := range byUser {
+		likes = latest(likes, maxLikesPerUser)
+		locations := make([]uint32, len(likes))
+		for i, l := range likes {
+			locations[i] = l.Location
+		}
+		liked[user] = locations
+	}
+
+	similarities := Similarities(liked, neighbours)
+	if len(similarities) == 0 {
+		logging.Log(logging.Warn, "no similarities computed, the previous ones are kept", logging.Fields{
+			"users": len(byUser),
+		})
+		return nil
+	}
+
+	now := time.Now().Unix()
+	bulk := db.C(Collection).Bulk()
+	bulk.Unordered()
+	for a, similar := range similarities {
+		bulk.Upsert(bson.M{"location": a}, Similarity{Location: a, Neighbours: similar, ComputedAt: now})
+	}
+	if _, err := bulk.Run(); err != nil {
+		return err
+	}
+
+	_, err := db.C(Collection).RemoveAll(bson.M{"computed_at": bson.M{"$lt": now}})
+	if err != nil {
+		return err
+	}
+
+	logging.Log(logging.Info, "similarities computed", logging.Fields{
+		"locations": len(similarities),
+		"users":     len(byUser),
+		"duration":  time.Since(started).String(),
+	})
+	return nil
+}
+
+// Run precomputes the similarities right away and then every interval until stop
+// is closed. It returns once the computation running then is over, so that the
+// session can be closed after it.
+func Run(s *mgo.Session, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := Precompute(s); err != nil {
+			logging.Log(logging.Error, "unable to compute similarities", logging.Fields{"error": err})
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Similarities ranks, for every location liked along with others, the limit
+// locations most similar to it, given the locations each user liked. The score of
+// two locations is the number of users who liked both divided by the geometric
+// mean of the numbers of users who liked each, ties going to the lower id.
+func Similarities(liked map[uint32][]uint32, limit int) map[uint32][]Neighbour {
+	likes := make(map[uint32]int)
+	co := make(map[uint32]map[uint32]int)
+	for _, locations := range liked {
+		locations = distinct(locations)
+		for _, a := range locations {
+			likes[a]++
+		}
+		for i, a := range locations {
+			for _, b := range locations[i+1:] {
+				count(co, a, b)
+				count(co, b, a)
+			}
+		}
+	}
+
+	similarities := make(map[uint32][]Neighbour, len(co))
+	for a, others := range co {
+		similar := make([]Neighbour, 0, len(others))
+		for b, both := range others {
+			score := float64(both) / math.Sqrt(float64(likes[a])*float64(likes[b]))
+			similar = append(similar, Neighbour{Location: b, Score: score})
+		}
+
+		sort.Slice(similar, func(i, j int) bool {
+			if similar[i].Score != similar[j].Score {
+				return similar[i].Score > similar[j].Score
+			}
+			return similar[i].Location < similar[j].Location
+		})
+		if len(similar) > limit {
+			similar = similar[:limit]
+		}
+		similarities[a] = similar
+	}
+	return similarities
+}
+
+// latest keeps the n most recent likes, in no particular order.
+func latest(likes []like, n int) []like {
+	if len(likes) <= n {
+		return likes
+	}
+	sort.Slice(likes, func(i, j int) bool {
+		if likes[i].VisitedAt != likes[j].VisitedAt {
+			return likes[i].VisitedAt > likes[j].VisitedAt
+		}
+		return likes[i].Location < likes[j].Location
+	})
+	return likes[:n]
+}
+
+func count(co map[uint32]map[uint32]int, a, b uint32) {
+	others, ok := co[a]
+	if !ok {
+		others = make(map[uint32]int)
+		co[a] = others
+	}
+	others[b]++
+}
+
+func distinct(locations []uint32) []uint32 {
+	seen := make(map[uint32]bool, len(locations))
+	unique := locations[:0]
+	for _, location := range locations {
+		if !seen[location] {
+			seen[location] = true
+			unique = append(unique, location)
+		}
+	}
+	return unique
+}
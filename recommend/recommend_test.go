@@ -0,0 +1,77 @@
+package recommend
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSimilarities(t *testing.T) {
+	got := Similarities(map[uint32][]uint32{
+		1: {10, 20, 30},
+		2: {10, 20, 20},
+		3: {10, 40},
+		4: {50},
+	}, 2)
+
+	// 10 is liked by 3 users, 20 by 2, 30 and 40 by 1; 50 has no neighbour.
+	want := map[uint32][]Neighbour{
+		10: {{Location: 20, Score: 2 / math.Sqrt(6)}, {Location: 30, Score: 1 / math.Sqrt(3)}},
+		20: {{Location: 10, Score: 2 / math.Sqrt(6)}, {Location: 30, Score: 1 / math.Sqrt(2)}},
+		30: {{Location: 20, Score: 1 / math.Sqrt(2)}, {Location: 10, Score: 1 / math.Sqrt(3)}},
+		40: {{Location: 10, Score: 1 / math.Sqrt(3)}},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for location, neighbours := range want {
+		if len(got[location]) != len(neighbours) {
+			t.Errorf("%d: got %v, want %v", location, got[location], neighbours)
+			continue
+		}
+		for i, n := range neighbours {
+			g := got[location][i]
+			if g.Location != n.Location || math.Abs(g.Score-n.Score) > 1e-12 {
+				t.Errorf("%d: got %v, want %v", location, got[location], neighbours)
+				break
+			}
+		}
+	}
+
+	// Ties go to the lower id: 30 and 40 are equally similar to 10 once 20 is out.
+	ties := Similarities(map[uint32][]uint32{1: {10, 40}, 2: {10, 30}}, 1)
+	if n := ties[10]; len(n) != 1 || n[0].Location != 30 {
+		t.Errorf("tie: got %v", n)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	likes := []like{
+		{Location: 1, VisitedAt: 100},
+		{Location: 2, VisitedAt: 300},
+		{Location: 3, VisitedAt: 200},
+		{Location: 4, VisitedAt: 300},
+	}
+
+	got := latest(likes, 3)
+	want := []like{
+		{Location: 2, VisitedAt: 300},
+		{Location: 4, VisitedAt: 300},
+		{Location: 3, VisitedAt: 200},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := latest(likes[:2], 3); len(got) != 2 {
+		t.Errorf("short list: got %v", got)
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	got := distinct([]uint32{3, 1, 3, 2, 1})
+	if want := []uint32{3, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+// Package reference holds the countries and cities known to the service, with
+// their ISO codes and the aliases they are commonly written as, so locations
+// can be stored and filtered under one canonical name.
+package reference
+
+import (
+	"embed"
+	"encoding/json"
+	"strings"
+)
+
+//go:embed data/*.json
+var data embed.FS
+
+type Country struct {
+	Code    string   `json:"code"`
+	Code3   string   `json:"code3"`
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+type City struct {
+	Name    string   `json:"name"`
+	Country string   `json:"country"`
+	Aliases []string `json:"aliases"`
+}
+
+var (
+	countries = make(map[string]Country)
+
+	// cities are keyed by the code of their country and their folded name or
+	// alias, cityNames by the folded name or alias alone, "" when cities of
+	// different names share it.
+	cities    map[string]City
+	cityNames map[string]string
+)
+
+func init() {
+	var all []Country
+	load("data/countries.json", &all)
+	for _, country := range all {
+		for _, key := range append([]string{country.Code, country.Code3, country.Name}, country.Aliases...) {
+			countries[fold(key)] = country
+		}
+	}
+
+	var known []City
+	load("data/cities.json", &known)
+	cities, cityNames = indexCities(known)
+}
+
+func indexCities(known []City) (map[string]City, map[string]string) {
+	byCountry := make(map[string]City)
+	byName := make(map[string]string)
+	for _, city := range known {
+		for _, key := range append([]string{city.Name}, city.Aliases...) {
+			key = fold(key)
+			byCountry[city.Country+" "+key] = city
+
+			if name, ok := byName[key]; ok && name != city.Name {
+				byName[key] = ""
+			} else {
+				byName[key] = city.Name
+			}
+		}
+	}
+	return byCountry, byName
+}
+
+func load(name string, v interface{}) {
+	raw, err := data.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		panic(name + ": " + err.Error())
+	}
+}
+
+func fold(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// LookupCountry finds a country by its alpha-2 or alpha-3 code, its name or one
+// of its aliases, ignoring case and surrounding spaces.
+func LookupCountry(s string) (Country, bool) {
+	country, ok := countries[fold(s)]
+	return country, ok
+}
+
+// LookupCity finds a city of a country, given as LookupCountry takes it, by its
+// name or one of its aliases, ignoring case and surrounding spaces.
+func LookupCity(country, s string) (City, bool) {
+	c, ok := LookupCountry(country)
+	if !ok {
+		return City{}, false
+	}
+	city, ok := cities[c.Code+" "+fold(s)]
+	return city, ok
+}
+
+// NormalizeCountry returns the canonical name and the alpha-2 code of a country,
+// or s trimmed and no code when the country is unknown.
+func NormalizeCountry(s string) (string, string) {
+	if country, ok := LookupCountry(s); ok {
+		return country.Name, country.Code
+	}
+	return strings.TrimSpace(s), ""
+}
+
+// NormalizeCity returns the canonical name of a city of country, or s trimmed
+// when the city is unknown there. When the country itself is unknown, e.g. empty
+// in a filter, s is resolved across countries as long as it is not ambiguous.
+func NormalizeCity(country, s string) string {
+	if _, ok := LookupCountry(country); ok {
+		if city, ok := LookupCity(country, s); ok {
+			return city.Name
+		}
+	} else if name := cityNames[fold(s)]; name != "" {
+		return name
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,96 @@
+package reference
+
+import "testing"
+
+func TestLookupCountry(t *testing.T) {
+	for _, s := range []string{"RU", "ru", "RUS", "Russia", "  russian   federation ", "Россия"} {
+		country, ok := LookupCountry(s)
+		if !ok || country.Code != "RU" || country.Name != "Russia" {
+			t.Errorf("%q: got %+v, %v", s, country, ok)
+		}
+	}
+
+	if country, ok := LookupCountry("Atlantis"); ok {
+		t.Errorf("unknown country: got %+v", country)
+	}
+}
+
+func TestNormalizeCountry(t *testing.T) {
+	tests := []struct {
+		s, name, code string
+	}{
+		{"uk", "United Kingdom", "GB"},
+		{"США", "United States", "US"},
+		{" Atlantis ", "Atlantis", ""},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		name, code := NormalizeCountry(tt.s)
+		if name != tt.name || code != tt.code {
+			t.Errorf("%q: got %q, %q, want %q, %q", tt.s, name, code, tt.name, tt.code)
+		}
+	}
+}
+
+func TestLookupCity(t *testing.T) {
+	for _, country := range []string{"RU", "Russia", "россия"} {
+		for _, s := range []string{"Saint Petersburg", "st. petersburg", "Питер", " ПЕТЕРБУРГ "} {
+			city, ok := LookupCity(country, s)
+			if !ok || city.Name != "Saint Petersburg" || city.Country != "RU" {
+				t.Errorf("%q, %q: got %+v, %v", country, s, city, ok)
+			}
+		}
+	}
+
+	for _, country := range []string{"US", "Atlantis", ""} {
+		if city, ok := LookupCity(country, "Питер"); ok {
+			t.Errorf("%q: found %+v in another country", country, city)
+		}
+	}
+}
+
+func TestNormalizeCity(t *testing.T) {
+	tests := []struct {
+		country, s, want string
+	}{
+		{"Germany", "München", "Munich"},
+		{"DE", "мюнхен", "Munich"},
+		{"US", "NYC", "New York"},
+		{"US", "Питер", "Питер"},
+		{"US", " Moscow ", "Moscow"},
+		{"", "Питер", "Saint Petersburg"},
+		{"Atlantis", "nyc", "New York"},
+		{"", " Springfield ", "Springfield"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeCity(tt.country, tt.s); got != tt.want {
+			t.Errorf("%q, %q: got %q, want %q", tt.country, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIndexCities(t *testing.T) {
+	byCountry, byName := indexCities([]City{
+		{Country: "US", Name: "Portland", Aliases: []string{"PDX"}},
+		{Country: "US", Name: "Portland, Maine", Aliases: []string{"Portland"}},
+		{Country: "GB", Name: "Boston"},
+		{Country: "US", Name: "Boston"},
+	})
+
+	if city := byCountry["US pdx"]; city.Name != "Portland" {
+		t.Errorf("US pdx: got %+v", city)
+	}
+	if city := byCountry["GB boston"]; city.Country != "GB" {
+		t.Errorf("GB boston: got %+v", city)
+	}
+
+	// Boston is the same name in both countries, Portland is not.
+	if byName["boston"] != "Boston" || byName["pdx"] != "Portland" {
+		t.Errorf("unambiguous names: got %q and %q", byName["boston"], byName["pdx"])
+	}
+	if name, ok := byName["portland"]; !ok || name != "" {
+		t.Errorf("ambiguous name: got %q, %v", name, ok)
+	}
+}
@@ -0,0 +1,92 @@
+// Package search splits the searchable fields of users and locations into the
+// lowercase words that prefix searches look up through an index, and scores
+// documents by the words starting with a search term.
+package search
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Field holds the words of a document, indexed on Field.w.
+const Field = "search_words"
+
+// Fields lists the searchable fields of every searchable entity with their
+// weight, the same weights the text indexes are built with.
+var Fields = map[string]map[string]int{
+	"locations": {"place": 3, "city": 2, "country": 1},
+	"users":     {"first_name": 2, "last_name": 2, "email": 1},
+}
+
+// Word is a word of a searchable field along with the weight of the field.
+type Word struct {
+	Word   string `bson:"w"`
+	Weight int    `bson:"f"`
+}
+
+// Terms splits s into lowercase words of letters and digits.
+func Terms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Words lists every word of the searchable fields of doc, an entity of the given
+// collection, field by field in name order.
+func Words(entity string, doc map[string]interface{}) []Word {
+	weights := Fields[entity]
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	words := []Word{}
+	for _, name := range names {
+		value, _ := doc[name].(string)
+		for _, term := range Terms(value) {
+			words = append(words, Word{Word: term, Weight: weights[name]})
+		}
+	}
+	return words
+}
+
+// PrefixScore rewards the words that start with a term without being equal to it,
+// at half the weight of their field. Whole words are scored by the text index.
+func PrefixScore(words []Word, terms []string) float64 {
+	var score float64
+	for _, w := range words {
+		for _, term := range terms {
+			if w.Word != term && strings.HasPrefix(w.Word, term) {
+				score += float64(w.Weight) / 2
+			}
+		}
+	}
+	return score
+}
+
+// PrefixScoreExpr computes PrefixScore over the words stored in Field as an
+// aggregation expression, so that documents can be ranked before being limited.
+func PrefixScoreExpr(terms []string) bson.M {
+	score := make([]interface{}, 0, len(terms)+1)
+	score = append(score, "$$value")
+	for _, term := range terms {
+		score = append(score, bson.M{"$cond": []interface{}{
+			bson.M{"$and": []interface{}{
+				bson.M{"$eq": []interface{}{bson.M{"$indexOfCP": []interface{}{"$$this.w", term}}, 0}},
+				bson.M{"$ne": []interface{}{"$$this.w", term}},
+			}},
+			bson.M{"$divide": []interface{}{"$$this.f", 2}},
+			0,
+		}})
+	}
+
+	return bson.M{"$reduce": bson.M{
+		"input":        bson.M{"$ifNull": []interface{}{"$" + Field, []interface{}{}}},
+		"initialValue": 0,
+		"in":           bson.M{"$add": score},
+	}}
+}
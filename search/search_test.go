@@ -0,0 +1,60 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	got := Terms("  Red-Square, MOSCOW 2017! ")
+	want := []string{"red", "square", "moscow", "2017"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := Terms(" -, "); len(got) != 0 {
+		t.Errorf("got %q, want no terms", got)
+	}
+}
+
+func TestWords(t *testing.T) {
+	got := Words("locations", map[string]interface{}{
+		"place":    "Red Square",
+		"city":     "Moscow",
+		"country":  "Russia",
+		"distance": 12,
+	})
+	want := []Word{{"moscow", 2}, {"russia", 1}, {"red", 3}, {"square", 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := Words("users", map[string]interface{}{"email": 1}); got == nil || len(got) != 0 {
+		t.Errorf("got %#v, want an empty list", got)
+	}
+}
+
+func TestPrefixScore(t *testing.T) {
+	words := Words("users", map[string]interface{}{
+		"first_name": "Marina",
+		"last_name":  "Mar",
+		"email":      "marina@mail.ru",
+	})
+
+	tests := []struct {
+		terms []string
+		want  float64
+	}{
+		{[]string{"mar"}, 1 + 0.5},
+		{[]string{"marina"}, 0},
+		{[]string{"ma"}, 1 + 1 + 0.5 + 0.5},
+		{[]string{"ivan", "ma"}, 1 + 1 + 0.5 + 0.5},
+		{[]string{"x"}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := PrefixScore(words, tt.terms); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.terms, got, tt.want)
+		}
+	}
+}
@@ -1,17 +1,120 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
 
 	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
 )
 
+const (
+	routeKey     = "route"
+	errorKey     = "error"
+	requestIdKey = "request_id"
+)
+
+func SetRequestId(ctx *fasthttp.RequestCtx, id string) {
+	ctx.SetUserValue(requestIdKey, id)
+}
+
+func RequestId(ctx *fasthttp.RequestCtx) string {
+	id, _ := ctx.UserValue(requestIdKey).(string)
+	return id
+}
+
+// RouteLabel names the route that served a request with numeric path segments
+// collapsed to <id>, so it can be used as a low-cardinality label.
+func RouteLabel(ctx *fasthttp.RequestCtx) string {
+	if route, ok := ctx.UserValue(routeKey).(string); ok {
+		return route
+	}
+
+	segments := strings.Split(string(ctx.Path()), "/")
+	for i, segment := range segments {
+		if _, err := strconv.ParseUint(segment, 10, 64); err == nil {
+			segments[i] = "<id>"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Unmatched is registered as a NotFound handler so that unknown paths share a
+// single route label.
+func Unmatched(ctx *routing.Context) error {
+	ctx.SetUserValue(routeKey, "unmatched")
+	return nil
+}
+
 func ResponseWithJSON(ctx *routing.Context, json []byte, code int) {
 	ctx.SetContentType("application/json; charset=utf-8")
 	ctx.SetStatusCode(code)
 	ctx.SetBody(json)
 }
 
+// ResponseWithError writes {"error": "..."} so clients can tell why a request was rejected.
+func ResponseWithError(ctx *routing.Context, err error, code int) {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	ResponseWithJSON(ctx, data, code)
+	ctx.SetUserValue(errorKey, err)
+}
+
+// ResponseWithFailure answers with an empty body and keeps err, when there is one,
+// for the access log.
+func ResponseWithFailure(ctx *routing.Context, err error, code int) {
+	ResponseWithJSON(ctx, []byte(""), code)
+	if err != nil {
+		ctx.SetUserValue(errorKey, err)
+	}
+}
+
+// RequestError returns the error a handler failed the request with, if any.
+func RequestError(ctx *fasthttp.RequestCtx) error {
+	err, _ := ctx.UserValue(errorKey).(error)
+	return err
+}
+
+// JSONBody guards routes reading a request body: it answers 415 unless the body is
+// sent as application/json and 413 when it is larger than maxSize bytes.
+func JSONBody(maxSize int) routing.Handler {
+	return func(ctx *routing.Context) error {
+		if len(ctx.Request.Body()) > maxSize {
+			ResponseWithError(ctx, fmt.Errorf("request body exceeds %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			ctx.Abort()
+			return nil
+		}
+
+		contentType := string(ctx.Request.Header.ContentType())
+		if i := strings.IndexByte(contentType, ';'); i >= 0 {
+			contentType = contentType[:i]
+		}
+
+		if !strings.EqualFold(strings.TrimSpace(contentType), "application/json") {
+			ResponseWithError(ctx, fmt.Errorf("unsupported content type %q", contentType), http.StatusUnsupportedMediaType)
+			ctx.Abort()
+			return nil
+		}
+
+		return nil
+	}
+}
+
+// UnmarshalObject decodes a JSON document with bson.UnmarshalJSON and, unlike it,
+// rejects any trailing data after the top-level value.
+func UnmarshalObject(data []byte, v interface{}) error {
+	if !json.Valid(data) {
+		return errors.New("request body is not a single valid JSON value")
+	}
+
+	return bson.UnmarshalJSON(data, v)
+}
+
 func ParseIdParameter(parameter interface{}) (id uint64, err error) {
 	stringID, ok := parameter.(string)
 	if !ok {
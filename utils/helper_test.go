@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+)
+
+func TestJSONBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        int
+	}{
+		{"application/json", `{"id":1}`, http.StatusOK},
+		{"application/json; charset=utf-8", `{"id":1}`, http.StatusOK},
+		{" Application/JSON ", `{"id":1}`, http.StatusOK},
+		{"application/json", strings.Repeat("x", 16), http.StatusOK},
+		{"application/json", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge},
+		{"text/plain", `{"id":1}`, http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", "id=1", http.StatusUnsupportedMediaType},
+		{"", `{"id":1}`, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		ctx := &routing.Context{RequestCtx: &fasthttp.RequestCtx{}}
+		ctx.Request.Header.SetContentType(tt.contentType)
+		ctx.Request.SetBodyString(tt.body)
+		ctx.Response.SetStatusCode(http.StatusOK)
+
+		JSONBody(16)(ctx)
+		if code := ctx.Response.StatusCode(); code != tt.want {
+			t.Errorf("%q with %d bytes: got %d, want %d", tt.contentType, len(tt.body), code, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalObject(t *testing.T) {
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`{"email":"a@b.c"}`, true},
+		{" {\"email\":\"a@b.c\"}\n", true},
+		{`{"email":"a@b.c"}{"email":"d@e.f"}`, false},
+		{`{"email":"a@b.c"} trailing`, false},
+		{`{"email":"a@b.c"`, false},
+		{``, false},
+	}
+
+	for _, tt := range tests {
+		var fields map[string]interface{}
+		err := UnmarshalObject([]byte(tt.data), &fields)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v", tt.data, err)
+			continue
+		}
+		if tt.ok && fields["email"] != "a@b.c" {
+			t.Errorf("%q: got %v", tt.data, fields)
+		}
+	}
+}